@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/runners"
+	"github.com/stretchr/testify/assert"
+)
+
+func cmdTask(name, cmd string) model.Task {
+	return model.Task{Name: name, Runner: "command", Args: model.TaskArgs{"_args": cmd}}
+}
+
+func runTestPlay(tasks []model.Task) (results []model.TaskResult, ok bool) {
+	pr := &playRunner{
+		play:     model.Play{Vars: model.TaskVars{"run": true}},
+		notified: map[string]bool{},
+		send:     func(tr model.TaskResult) { results = append(results, tr) },
+	}
+	ok = true
+	for _, task := range tasks {
+		if !pr.runTask(task, false) {
+			ok = false
+			break
+		}
+	}
+	return results, ok
+}
+
+func statuses(results []model.TaskResult) (s []string) {
+	for _, tr := range results {
+		switch {
+		case tr.Rescued:
+			s = append(s, tr.Task.Name+":rescued")
+		case tr.Status == runners.Failed:
+			s = append(s, tr.Task.Name+":failed")
+		case tr.Status == runners.Skipped:
+			s = append(s, tr.Task.Name+":skipped")
+		default:
+			s = append(s, tr.Task.Name+":ok")
+		}
+	}
+	return s
+}
+
+func Test_runBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		block model.Task
+		want  []string
+		ok    bool
+	}{
+		{
+			name: "block succeeds",
+			block: model.Task{
+				Block:  []model.Task{cmdTask("a", "true"), cmdTask("b", "true")},
+				Rescue: []model.Task{cmdTask("r", "true")},
+				Always: []model.Task{cmdTask("x", "true")},
+			},
+			want: []string{"a:ok", "b:ok", "r:skipped", "x:ok"},
+			ok:   true,
+		},
+		{
+			name: "block is rescued",
+			block: model.Task{
+				Block:  []model.Task{cmdTask("a", "false"), cmdTask("b", "true")},
+				Rescue: []model.Task{cmdTask("r", "true")},
+				Always: []model.Task{cmdTask("x", "true")},
+			},
+			want: []string{"a:rescued", "b:skipped", "r:ok", "x:ok"},
+			ok:   true,
+		},
+		{
+			name: "rescue fails",
+			block: model.Task{
+				Block:  []model.Task{cmdTask("a", "false")},
+				Rescue: []model.Task{cmdTask("r", "false")},
+				Always: []model.Task{cmdTask("x", "true")},
+			},
+			want: []string{"a:rescued", "r:failed", "x:ok"},
+			ok:   false,
+		},
+		{
+			name: "no rescue",
+			block: model.Task{
+				Block:  []model.Task{cmdTask("a", "false")},
+				Always: []model.Task{cmdTask("x", "true")},
+			},
+			want: []string{"a:failed", "x:ok"},
+			ok:   false,
+		},
+		{
+			name: "nested block is rescued by parent",
+			block: model.Task{
+				Block: []model.Task{
+					{Block: []model.Task{cmdTask("a", "false"), cmdTask("b", "true")}},
+					cmdTask("c", "true"),
+				},
+				Rescue: []model.Task{cmdTask("r", "true")},
+			},
+			want: []string{"a:rescued", "b:skipped", "c:skipped", "r:ok"},
+			ok:   true,
+		},
+		{
+			name: "when is false",
+			block: model.Task{
+				When:   "not run",
+				Block:  []model.Task{cmdTask("a", "true")},
+				Rescue: []model.Task{cmdTask("r", "true")},
+			},
+			want: []string{"a:skipped", "r:skipped"},
+			ok:   true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			results, ok := runTestPlay([]model.Task{tc.block})
+			assert.Equal(t, tc.want, statuses(results))
+			assert.Equal(t, tc.ok, ok)
+			// the controller expects a result for every task
+			assert.Len(t, results, len(model.FlattenTasks([]model.Task{tc.block})))
+		})
+	}
+}
+
+func Test_blobErr(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tree := model.Task{Name: "t", Runner: "tree", Args: model.TaskArgs{"_assets": model.Asset{
+		Files: []model.File{{Path: "etc/motd", Hash: hash}},
+	}}}
+	var results []model.TaskResult
+	pr := &playRunner{
+		notified: map[string]bool{},
+		send:     func(tr model.TaskResult) { results = append(results, tr) },
+		blobErrs: map[string]error{hash: errors.New("disk full")},
+	}
+	assert.False(t, pr.runTask(tree, false))
+	assert.Equal(t, []string{"t:failed"}, statuses(results))
+	assert.Equal(t, "cannot receive etc/motd: disk full", results[0].Output)
+
+	// tasks without the blob still run
+	results = nil
+	assert.True(t, pr.runTask(cmdTask("a", "true"), false))
+	assert.Equal(t, []string{"a:ok"}, statuses(results))
+}
+
+func Test_stripInternalArgs(t *testing.T) {
+	unit := model.Task{Runner: "systemd_unit", Args: model.TaskArgs{
+		"name":      "app",
+		"template":  "app.service",
+		"_template": "secret",
+		"_assets":   model.Asset{},
+	}}
+	stripped := stripInternalArgs(&unit)
+	assert.Equal(t, model.TaskArgs{"name": "app", "template": "app.service"}, stripped.Args)
+	// the task itself is untouched, as handlers can run again
+	assert.Equal(t, "secret", unit.Args["_template"])
+
+	shell := cmdTask("a", "true")
+	assert.Equal(t, shell.Args, stripInternalArgs(&shell).Args)
+	assert.Nil(t, stripInternalArgs(nil))
+}
@@ -4,127 +4,261 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	log "github.com/gwillem/go-simplelog"
 	"github.com/gwillem/whip/internal/assets"
 	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
 	"github.com/gwillem/whip/internal/runners"
 )
 
 func main() {
 	start := time.Now()
 	log.Task("Running deputy at", time.Now().UTC().Format(time.RFC3339))
-	runJob(getJobFromStdin())
+	setBlobDir()
+	job, blobErrs := getJobFromStdin()
+	// before the run, as the assets are removed from the results
+	files := assets.JobFiles(job)
+	runJob(job, blobErrs)
+	if err := assets.CleanBlobs(files); err != nil {
+		log.Warn("Cannot clean blob cache:", err)
+	}
 	log.Ok("Finished deputy (" + time.Since(start).Round(time.Millisecond).String() + ")")
 }
 
-func runJob(job *model.Job) {
+func runJob(job *model.Job, blobErrs map[string]error) {
 	// send task results back to whip
 	encoder := gob.NewEncoder(os.Stdout)
 
+	// back up changed files, so they can be restored with "whip rollback"
+	runners.SetRunID(job.RunID)
+	defer func() {
+		if err := runners.FinishRun(); err != nil {
+			log.Warn("Cannot write backup manifest:", err)
+		}
+	}()
+
+	send := func(tr model.TaskResult) {
+		tr.Task = stripInternalArgs(tr.Task)
+		tr.RunID = job.RunID
+		if err := encoder.Encode(tr); err != nil {
+			panic(err)
+		}
+	}
+
 	for _, play := range job.Playbook {
-		handlers := map[string]bool{}
-		for _, task := range play.Tasks {
+		// handlers that are not defined, but named like nginx-reload,
+		// are run with the service runner
+		pr := &playRunner{
+			play:     play,
+			handlers: slices.Concat(play.Handlers, runners.AutoHandlers(play)),
+			notified: map[string]bool{},
+			send:     send,
+			blobErrs: blobErrs,
+		}
 
-			var tr model.TaskResult
-			if task.Unless != "" {
-				if _, err := exec.Command("/bin/sh", "-c", task.Unless).CombinedOutput(); err == nil {
-					tr.Status = runners.Success
-					tr.Output = fmt.Sprintf("skipped, 'unless' clause succeeded (%v)", task.Unless)
-				}
+		for _, task := range play.Tasks {
+			// terminate play for this host if any task failed
+			if !pr.runTask(task, false) {
+				return
 			}
+		}
 
-			// if no "unless" or "unless" cmd failed, run the task
-			if tr.Status == runners.Unknown {
-				tr = runners.Run(&task, play.Vars)
-			}
+		if !runHandlers(pr.handlers, pr.notified, play.Vars, send) {
+			return
+		}
+	}
+}
 
-			if tr.Task == nil {
-				tr.Task = &task // todo, this seems redundant
-			}
+// playRunner runs the tasks of a play, including blocks
+type playRunner struct {
+	play     model.Play
+	handlers []model.Task
+	notified map[string]bool
+	send     func(model.TaskResult)
+	blobErrs map[string]error // assets that could not be received
+}
 
-			// don't echo back all the files..
-			delete(tr.Task.Args, "_assets")
+// runTask runs a task or block and returns false if it failed. A failure
+// inside a block with a rescue section (at any level) is marked as rescued.
+func (p *playRunner) runTask(task model.Task, rescuable bool) bool {
+	ok, err := runners.EvalWhen(&task, p.play.Vars)
+	if err != nil {
+		p.send(model.TaskResult{Status: runners.Failed, Output: err.Error(), Task: &task, Rescued: rescuable})
+		return false
+	}
+	if !ok {
+		p.skip([]model.Task{task}, fmt.Sprintf("skipped, 'when' condition is false (%v)", task.When))
+		return true
+	}
 
-			if err := encoder.Encode(tr); err != nil {
-				panic(err)
-			}
+	if task.IsBlock() {
+		return p.runBlock(task, rescuable)
+	}
 
-			// terminate play for this host if any task failed
-			if tr.Status == runners.Failed {
-				return
-			}
+	if runners.IsFlushHandlers(task) {
+		p.send(model.TaskResult{Status: runners.Success, Output: "flushed handlers", Task: &task})
+		return runHandlers(p.handlers, p.notified, p.play.Vars, p.send)
+	}
 
-			if tr.Changed {
-				for _, h := range task.Notify {
-					handlers[h] = true
-				}
-				// individual notifies, for example for the tree runner
-				for h := range tr.Notify {
-					handlers[h] = true
-				}
-			}
+	if err := p.blobErr(task); err != nil {
+		p.send(model.TaskResult{Status: runners.Failed, Output: err.Error(), Task: &task, Rescued: rescuable})
+		return false
+	}
 
+	var tr model.TaskResult
+	if task.Unless != "" {
+		if _, err := exec.Command("/bin/sh", "-c", task.Unless).CombinedOutput(); err == nil {
+			tr.Status = runners.Success
+			tr.Output = fmt.Sprintf("skipped, 'unless' clause succeeded (%v)", task.Unless)
 		}
-		for _, handler := range play.Handlers {
-			// empty tr in case of unnotified handler
-			tr := model.TaskResult{Status: runners.Skipped}
+	}
 
-			if handlers[handler.Name] {
-				// log.Debug("Running handler", handler)
-				tr = runners.Run(&handler, play.Vars)
-				delete(handlers, handler.Name)
-			}
-			tr.Task = &handler
-			if tr.Task.Runner != "" {
-				tr.Task.Runner = "handler:" + handler.Runner // todo fixme
-			}
-			delete(tr.Task.Args, "_assets")
-			if err := encoder.Encode(tr); err != nil {
-				panic(err)
-			}
-			if tr.Status == runners.Failed {
-				return
-			}
+	// if no "unless" or "unless" cmd failed, run the task
+	if tr.Status == runners.Unknown {
+		tr = runners.Run(&task, p.play.Vars)
+	}
+
+	if tr.Task == nil {
+		tr.Task = &task // todo, this seems redundant
+	}
+	if tr.Status == runners.Failed {
+		tr.Rescued = rescuable
+		p.send(tr)
+		return false
+	}
+	p.send(tr)
+
+	if tr.Changed {
+		for _, h := range task.Notify {
+			p.notified[h] = true
+		}
+		// individual notifies, for example for the tree runner
+		for h := range tr.Notify {
+			p.notified[h] = true
+		}
+	}
+	return true
+}
+
+// blobErr returns an error if any of the assets of task could not be
+// written to the blob cache
+func (p *playRunner) blobErr(task model.Task) error {
+	for _, f := range assets.TaskFiles(task) {
+		if err := p.blobErrs[f.Hash]; err != nil {
+			return fmt.Errorf("cannot receive %s: %w", f.Path, err)
 		}
+	}
+	return nil
+}
 
-		/*
-			// Run any auto-handlers TODO should fix play count on whip host
-			for handlerName := range handlers {
-				service, action := parseAutoHandler(handlerName)
-				if service == "" || action == "" {
-					panic("invalid auto handler: " + handlerName) // FIXME
-				}
-				task := model.Task{
-					Runner: "service",
-					Args: map[string]any{
-						"name":  service,
-						"state": action,
-					},
-				}
-				tr := runners.Run(&task, play.Vars)
-				if err := encoder.Encode(tr); err != nil {
-					panic(err)
-				}
+// runBlock runs the block section, then the rescue section if the block
+// failed and finally the always section. It returns false if the block
+// failed and wasn't rescued, or if the always section failed.
+func (p *playRunner) runBlock(b model.Task, rescuable bool) bool {
+	hasRescue := len(b.Rescue) > 0
+	ok := p.runSection(b.Block, rescuable || hasRescue)
+	switch {
+	case ok:
+		p.skip(b.Rescue, "skipped, block succeeded")
+	case hasRescue:
+		ok = p.runSection(b.Rescue, rescuable)
+	}
+	if !p.runSection(b.Always, rescuable) {
+		ok = false
+	}
+	return ok
+}
+
+// runSection runs tasks until one fails, the rest are skipped
+func (p *playRunner) runSection(tasks []model.Task, rescuable bool) bool {
+	for i, task := range tasks {
+		if !p.runTask(task, rescuable) {
+			p.skip(tasks[i+1:], "skipped, previous task in block failed")
+			return false
+		}
+	}
+	return true
+}
+
+// skip sends a skipped result for every task (and handler of a skipped
+// flush_handlers), so the controller gets the number of results it expects
+func (p *playRunner) skip(tasks []model.Task, reason string) {
+	for _, task := range model.FlattenTasks(tasks) {
+		p.send(model.TaskResult{Status: runners.Skipped, Output: reason, Task: &task})
+		if runners.IsFlushHandlers(task) {
+			for _, h := range p.handlers {
+				h.Runner = "handler:" + h.Runner
+				p.send(model.TaskResult{Status: runners.Skipped, Task: &h})
 			}
-		*/
+		}
 	}
 }
 
-// func parseAutoHandler(handlerName string) (service, action string) {
-// 	service, action, _ = strings.Cut(handlerName, "-")
+// runHandlers runs the handlers that are notified by name or listen topic,
+// in the order they are defined, and clears the notifications. Every handler
+// sends a result (possibly skipped), so the controller knows what to expect.
+// Auto handlers for names that were only notified at runtime (such as by
+// rollback) run last. It returns false if a handler failed.
+func runHandlers(handlers []model.Task, notified map[string]bool, vars model.TaskVars, send func(model.TaskResult)) bool {
+	pending := maps.Clone(notified)
+	clear(notified)
+	handlers = slices.Concat(handlers, runners.UnhandledAutoHandlers(handlers, pending))
 
-// 	if !slices.Contains([]string{"restart", "reload"}, action) {
-// 		log.Errorf("Invalid auto handler action: %s", action)
-// 		return "", ""
-// 	}
-// 	return
-// }
+	for _, handler := range handlers {
+		// empty tr in case of unnotified handler
+		tr := model.TaskResult{Status: runners.Skipped}
 
-func getJobFromStdin() *model.Job {
+		if runners.Notified(handler, pending) {
+			tr = runners.Run(&handler, vars)
+		}
+		tr.Task = &handler
+		if tr.Task.Runner != "" {
+			tr.Task.Runner = "handler:" + handler.Runner // todo fixme
+		}
+		send(tr)
+		if tr.Status == runners.Failed {
+			return false
+		}
+	}
+	return true
+}
+
+// stripInternalArgs returns a copy of task without the args that prerun
+// adds, such as _assets and _template, so we don't echo back all the files
+// or decrypted secrets. The free-form _args are kept.
+func stripInternalArgs(task *model.Task) *model.Task {
+	if task == nil {
+		return nil
+	}
+	t := *task
+	t.Args = maps.Clone(task.Args)
+	maps.DeleteFunc(t.Args, func(k string, _ any) bool {
+		return strings.HasPrefix(k, "_") && k != parser.DefaultArg
+	})
+	return &t
+}
+
+// setBlobDir points the asset cache to the blobs dir next to our binary,
+// which is where the controller looks for cached blobs over ssh
+func setBlobDir() {
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	assets.SetBlobDir(filepath.Join(filepath.Dir(exe), "blobs"))
+}
+
+// getJobFromStdin reads the job and the blobs that follow it. Blobs that
+// cannot be written are returned by hash, so the tasks that need them fail.
+func getJobFromStdin() (*model.Job, map[string]error) {
 	stdinReader := assets.NewReadCounter(os.Stdin)
 	pr, pw := io.Pipe()
 	go func() {
@@ -142,8 +276,38 @@ func getJobFromStdin() *model.Job {
 		log.Errorf("gob decode: %w", err)
 	}
 
+	// the job is followed by the asset blobs that are not in our cache yet,
+	// streamed in chunks straight to disk
+	bw := &assets.BlobWriter{}
+	defer bw.Close()
+	blobs := 0
+	blobErrs := map[string]error{}
+	for {
+		var b model.Blob
+		err := decoder.Decode(&b)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Errorf("gob decode blob: %w", err)
+			break
+		}
+		if blobErrs[b.Hash] != nil {
+			continue // skip the rest of a failed blob
+		}
+		if err := bw.Write(b); err != nil {
+			log.Warn("Cannot write blob:", err)
+			blobErrs[b.Hash] = err
+			_ = bw.Close()
+			continue
+		}
+		if b.Last {
+			blobs++
+		}
+	}
+	log.Debug("Received blobs:", blobs)
+
 	ratio := fmt.Sprintf("%.0f%%", 100*float64(stdinReader.Count())/float64(decompressedReader.Count()))
 	log.Debug("Compesssed size/ratio:", stdinReader.Count(), ratio)
 
-	return job
+	return job, blobErrs
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/parser"
+	"github.com/gwillem/whip/internal/runners"
+	"github.com/spf13/cobra"
+)
+
+// runDoc prints the reference of one or all runners, from their metadata
+func runDoc(cmd *cobra.Command, args []string) {
+	names := runners.All()
+	if len(args) > 0 {
+		if _, ok := runners.Meta(args[0]); !ok {
+			log.Fatal(fmt.Sprintf("unknown runner %q%s", args[0], parser.Suggest(args[0], names)))
+		}
+		names = args
+	}
+
+	markdown, _ := cmd.Flags().GetBool("markdown")
+	switch {
+	case markdown:
+		writeMarkdownDoc(os.Stdout, names)
+	case len(args) == 0:
+		writeRunnerList(os.Stdout, names)
+	default:
+		writeRunnerDoc(os.Stdout, names[0])
+	}
+}
+
+func writeRunnerList(w io.Writer, names []string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		meta, _ := runners.Meta(name)
+		fmt.Fprintf(tw, "%s\t%s\n", name, meta.Desc)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nUse \"whip doc <runner>\" for its args and examples.")
+}
+
+func writeRunnerDoc(w io.Writer, name string) {
+	meta, _ := runners.Meta(name)
+	fmt.Fprintf(w, "%s - %s\n\n", name, meta.Desc)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, a := range meta.Args {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", argName(a), a.Kind, argDesc(a))
+	}
+	tw.Flush()
+
+	if meta.Extra != "" {
+		fmt.Fprintf(w, "\nAlso takes %s\n", meta.Extra)
+	}
+	for _, group := range meta.Exclusive {
+		fmt.Fprintf(w, "\nCannot combine %s\n", strings.Join(group, " and "))
+	}
+	for _, example := range meta.Examples {
+		fmt.Fprintf(w, "\nExample:\n%s", indent(strings.TrimLeft(example, "\n"), "  "))
+	}
+}
+
+func writeMarkdownDoc(w io.Writer, names []string) {
+	fmt.Fprint(w, "# Runner reference\n\nGenerated with `whip doc --markdown`.\n")
+	for _, name := range names {
+		meta, _ := runners.Meta(name)
+		fmt.Fprintf(w, "\n## %s\n\n%s\n\n", name, meta.Desc)
+		fmt.Fprint(w, "| Arg | Type | Description |\n| --- | ---- | ----------- |\n")
+		for _, a := range meta.Args {
+			fmt.Fprintf(w, "| `%s` | %s | %s |\n", argName(a), a.Kind, strings.ReplaceAll(argDesc(a), "|", "\\|"))
+		}
+		if meta.Extra != "" {
+			fmt.Fprintf(w, "\nAlso takes %s\n", meta.Extra)
+		}
+		for _, group := range meta.Exclusive {
+			fmt.Fprintf(w, "\nCannot combine `%s`.\n", strings.Join(group, "` and `"))
+		}
+		for _, example := range meta.Examples {
+			fmt.Fprintf(w, "\n```yaml\n%s```\n", strings.TrimLeft(example, "\n"))
+		}
+	}
+}
+
+func argName(a runners.Arg) string {
+	if a.Name == parser.DefaultArg {
+		return "(free-form)"
+	}
+	return a.Name
+}
+
+// argDesc describes an arg, including whether it is required, its values
+// and default
+func argDesc(a runners.Arg) string {
+	parts := []string{}
+	if a.Required {
+		parts = append(parts, "Required.")
+	}
+	if a.Desc != "" {
+		parts = append(parts, strings.ToUpper(a.Desc[:1])+a.Desc[1:]+".")
+	}
+	if len(a.Enum) > 0 {
+		parts = append(parts, "One of "+strings.Join(a.Enum, "|")+".")
+	}
+	if a.Default != "" {
+		parts = append(parts, "Default "+a.Default+".")
+	}
+	return strings.Join(parts, " ")
+}
+
+func indent(s, prefix string) string {
+	lines := strings.SplitAfter(s, "\n")
+	for i, l := range lines {
+		if strings.TrimSpace(l) != "" {
+			lines[i] = prefix + l
+		}
+	}
+	return strings.Join(lines, "")
+}
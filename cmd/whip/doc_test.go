@@ -0,0 +1,25 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gwillem/whip/internal/runners"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_writeMarkdownDoc(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writeMarkdownDoc(buf, runners.All())
+	out := buf.String()
+	for _, name := range runners.All() {
+		assert.Contains(t, out, "\n## "+name+"\n")
+	}
+	assert.Contains(t, out, "| `state` | string | For all packages. One of present\\|latest\\|absent\\|purged. Default present. |")
+	assert.Contains(t, out, "```yaml\n- apt:")
+}
+
+func Test_argDesc(t *testing.T) {
+	a := runners.Arg{Name: "src", Required: true, Desc: "dir on the controller"}
+	assert.Equal(t, "Required. Dir on the controller.", argDesc(a))
+}
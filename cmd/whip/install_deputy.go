@@ -4,23 +4,32 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/gwillem/whip/internal/assets"
 	"github.com/gwillem/whip/internal/ssh"
 )
 
-func ensureDeputy(c *ssh.Client) error {
+// ensureDeputy uploads the deputy if needed and returns the asset blobs
+// that are already cached at the target
+func ensureDeputy(c *ssh.Client) (map[string]bool, error) {
 	uname, err := c.Run(`
 			uname -sm; 
-			mkdir -p ~/.cache/whip 2>/dev/null
+			mkdir -p ~/.cache/whip ~/` + assets.RemoteBlobDir + ` 2>/dev/null
 			touch ~/.cache/whip/deputy 2>/dev/null;
 			sha256sum ~/.cache/whip/deputy 2>/dev/null | awk '{print $1}';
+			ls ~/` + assets.RemoteBlobDir + ` 2>/dev/null;
 			`)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	lines := strings.Split(strings.TrimSpace(uname), "\n")
-	if len(lines) != 2 {
-		return fmt.Errorf("unexpected output from uname: %s", uname)
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("unexpected output from uname: %s", uname)
+	}
+
+	blobs := map[string]bool{}
+	for _, b := range lines[2:] {
+		blobs[strings.TrimSpace(b)] = true
 	}
 
 	osarch := strings.ToLower(lines[0])
@@ -32,12 +41,12 @@ func ensureDeputy(c *ssh.Client) error {
 
 	myDep, err := deputies.ReadFile("deputies/" + osarch)
 	if err != nil {
-		return fmt.Errorf("could not read deputy for %s: %s", osarch, err)
+		return nil, fmt.Errorf("could not read deputy for %s: %s", osarch, err)
 	}
 
 	localShaBytes, err := deputies.ReadFile("deputies/" + osarch + ".sha256")
 	if err != nil {
-		return fmt.Errorf("could not read deputy SHA256 for %s: %s", osarch, err)
+		return nil, fmt.Errorf("could not read deputy SHA256 for %s: %s", osarch, err)
 	}
 	localSha := strings.TrimSpace(string(localShaBytes))
 
@@ -45,13 +54,13 @@ func ensureDeputy(c *ssh.Client) error {
 
 	if localSha == remoteSha {
 		// log.Debug("remote deputy seems to be fine")
-		return nil
+		return blobs, nil
 	}
 
 	// log.Debug("uploading deputy for ", osarg)
 	if err := c.UploadBytesXZ(myDep, deputyPath, 0o755); err != nil {
-		return fmt.Errorf("Could not upload deputy: %s", err)
+		return nil, fmt.Errorf("Could not upload deputy: %s", err)
 	}
 
-	return nil
+	return blobs, nil
 }
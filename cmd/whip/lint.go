@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/playbook"
+	"github.com/spf13/cobra"
+)
+
+// runLint loads and lints a playbook without running it, so CI can gate
+// playbook changes. It exits non-zero if there are any problems.
+func runLint(cmd *cobra.Command, args []string) {
+	setVerbosityLevel(cmd)
+	playbookPath := getPlaybookPath(args)
+	vaults := playbook.VaultValues{}
+	extraVars := getExtraVars(cmd, vaults)
+	if err := os.Chdir(filepath.Dir(playbookPath)); err != nil {
+		log.Fatal(err)
+	}
+	pb := loadPlaybook(filepath.Base(playbookPath), extraVars, vaults)
+	log.Ok("No problems found in", playbookPath, "with", len(*pb), "plays")
+}
+
+// loadPlaybook loads and lints a playbook, exiting with all problems listed
+// if it is invalid. Its inline !vault values are added to vaults.
+func loadPlaybook(path string, extraVars map[string]any, vaults playbook.VaultValues) *model.Playbook {
+	pb, err := playbook.LoadWithVars(path, extraVars, vaults)
+	if err == nil {
+		err = playbook.Lint(pb)
+	}
+	if err != nil {
+		// always list the problems, regardless of verbosity
+		fmt.Fprintln(os.Stderr, err)
+		log.Fatal(fmt.Sprintf("Found %d problems in %s", countProblems(err), path))
+	}
+	return pb
+}
+
+func countProblems(err error) int {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return len(joined.Unwrap())
+	}
+	return 1
+}
+
+// getExtraVars parses the -e args, which are relative to the working dir,
+// so call it before changing to the playbook dir
+func getExtraVars(cmd *cobra.Command, vaults playbook.VaultValues) map[string]any {
+	args, err := cmd.Flags().GetStringArray("extra-vars")
+	if err != nil {
+		log.Fatal(err)
+	}
+	vars, err := playbook.ParseExtraVars(args, vaults)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return vars
+}
@@ -40,6 +40,40 @@ var (
 			}
 		},
 	}
+	vaultCmd = &cobra.Command{
+		Use:   "vault",
+		Short: "Encrypt inline secrets",
+	}
+	vaultEncryptStringCmd = &cobra.Command{
+		Use:   "encrypt-string [value]",
+		Short: "Encrypt a value for use as inline !vault value, reads stdin if no value is given",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runEncryptString,
+	}
+	rollbackCmd = &cobra.Command{
+		Use:   "rollback <host> <run-id>",
+		Short: "Restore the files changed at host during a previous run",
+		Args:  cobra.ExactArgs(2),
+		Run:   runRollback,
+	}
+	lintCmd = &cobra.Command{
+		Use:   "lint [playbook]",
+		Short: "Check a playbook for problems, without running it",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runLint,
+	}
+	docCmd = &cobra.Command{
+		Use:   "doc [runner]",
+		Short: "Show the args and examples of the runners",
+		Args:  cobra.MaximumNArgs(1),
+		Run:   runDoc,
+	}
+	schemaCmd = &cobra.Command{
+		Use:   "schema",
+		Short: "Print a JSON Schema for playbooks, for editor completion and validation",
+		Args:  cobra.NoArgs,
+		Run:   runSchema,
+	}
 	versionCmd = &cobra.Command{
 		Use:   "version",
 		Short: "Print the version number of Whip",
@@ -59,9 +93,15 @@ var (
 )
 
 func init() {
-	rootCmd.AddCommand(vaultEditCmd, vaultConvertCmd, versionCmd, updateCmd)
+	vaultCmd.AddCommand(vaultEncryptStringCmd)
+	rootCmd.AddCommand(vaultEditCmd, vaultConvertCmd, vaultCmd, rollbackCmd, lintCmd, docCmd, schemaCmd, versionCmd, updateCmd)
 	rootCmd.CompletionOptions.HiddenDefaultCmd = true
 	rootCmd.PersistentFlags().CountP("verbose", "v", "verbose output")
+	for _, cmd := range []*cobra.Command{rootCmd, lintCmd} {
+		cmd.Flags().StringArrayP("extra-vars", "e", nil, "set vars as key=value or @file.yml, these take precedence over all other vars")
+	}
+	vaultEncryptStringCmd.Flags().String("name", "", "print as yaml key with this name")
+	docCmd.Flags().Bool("markdown", false, "print a reference page in markdown")
 }
 
 func main() {
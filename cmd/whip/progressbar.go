@@ -84,7 +84,7 @@ func (m tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		b.total = msg.TaskTotal
 		b.idx = msg.TaskIdx
 
-		if tr.Status == runners.Failed {
+		if tr.Status == runners.Failed && !tr.Rescued {
 			b.status = ERROR
 		} else if perc >= 1 {
 			b.status = DONE
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"time"
 
@@ -43,6 +42,9 @@ func (h verboseHandler) Send(m model.ReportMsg) {
 	case tr.Changed && tr.Status == runners.Success:
 		statusColor = yellow
 		status = "changed"
+	case tr.Rescued:
+		statusColor = yellow
+		status = "rescued"
 	case tr.Status == runners.Failed:
 		statusColor = red
 		status = "error"
@@ -79,7 +81,9 @@ func trimDotDot(s string, lim int) string {
 	return s + strings.Repeat(" ", lim-len(s))
 }
 
-func reportResults(results <-chan model.TaskResult, stats map[model.TargetName]map[string]int, verbosity int) {
+// reportResults shows the results as they come in and returns false if any
+// of them failed (and was not rescued)
+func reportResults(results <-chan model.TaskResult, stats map[model.TargetName]map[string]int, verbosity int) bool {
 	var handler resultHandler = verboseHandler{}
 	if verbosity == 0 {
 		handler = tuiHandler{createTui()}
@@ -96,6 +100,9 @@ func reportResults(results <-chan model.TaskResult, stats map[model.TargetName]m
 		switch {
 		case res.Changed && res.Status == runners.Success:
 			stats[res.Host]["changed"]++
+		case res.Rescued:
+			// failed, but the rescue section of its block took over
+			stats[res.Host]["rescued"]++
 		case res.Status == runners.Failed:
 			stats[res.Host]["error"]++
 		case res.Status == runners.Skipped:
@@ -109,7 +116,7 @@ func reportResults(results <-chan model.TaskResult, stats map[model.TargetName]m
 			TaskTotal:  stats[res.Host]["total"],
 			TaskResult: res,
 		})
-		if res.Status == runners.Failed {
+		if res.Status == runners.Failed && !res.Rescued {
 			failed = append(failed, res)
 		}
 	}
@@ -130,7 +137,5 @@ func reportResults(results <-chan model.TaskResult, stats map[model.TargetName]m
 			log.Ok(fmt.Sprint(k, " ", stats))
 		}
 	}
-	if len(failed) > 0 {
-		os.Exit(1)
-	}
+	return len(failed) == 0
 }
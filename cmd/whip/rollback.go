@@ -0,0 +1,60 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/fsutil"
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/playbook"
+	"github.com/spf13/cobra"
+)
+
+// runRollback restores the files that were changed at the target during
+// the given run. Handlers are taken from the plays in the local playbook
+// (if any) that target this host, so that notified services are reloaded.
+func runRollback(cmd *cobra.Command, args []string) {
+	verbosity := setVerbosityLevel(cmd)
+	target, runID := model.TargetName(args[0]), args[1]
+
+	play := model.Play{
+		Name:  "rollback " + runID,
+		Vars:  map[string]any{},
+		Hosts: []model.TargetName{target},
+		Tasks: []model.Task{{
+			Runner: "rollback",
+			Args:   model.TaskArgs{"run_id": runID},
+		}},
+	}
+
+	if playbookPath := fsutil.FindAncestorPath(defaultPlaybookPath); playbookPath != "" {
+		if err := os.Chdir(filepath.Dir(playbookPath)); err != nil {
+			log.Fatal(err)
+		}
+		vaults := playbook.VaultValues{}
+		pb, err := playbook.LoadWithVars(filepath.Base(playbookPath), nil, vaults)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range *pb {
+			if slices.Contains(p.Hosts, target) {
+				play.Handlers = append(play.Handlers, p.Handlers...)
+				maps.Copy(play.Vars, p.Vars)
+			}
+		}
+		if err := playbook.Decrypt(&model.Playbook{play}, vaults); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	jobBook := map[model.TargetName]model.Job{
+		target: {RunID: newRunID(), Playbook: model.Playbook{play}},
+	}
+	if !runJobBook(jobBook, verbosity) {
+		log.Fatal("Rollback of run", runID, "at", target, "failed")
+	}
+	log.Ok("Rolled back run", runID, "at", target)
+}
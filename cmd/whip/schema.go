@@ -0,0 +1,19 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/playbook"
+	"github.com/spf13/cobra"
+)
+
+// runSchema prints the JSON Schema for playbooks, for editor integration
+func runSchema(cmd *cobra.Command, args []string) {
+	data, err := json.MarshalIndent(playbook.Schema(), "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/vault"
+	"github.com/spf13/cobra"
+)
+
+// runEncryptString prints an inline !vault value for a playbook or vars
+// file. The value is read from stdin if not given, so it doesn't end up in
+// the shell history.
+func runEncryptString(cmd *cobra.Command, args []string) {
+	var plain string
+	if len(args) > 0 {
+		plain = args[0]
+	} else {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		plain = strings.TrimSuffix(string(data), "\n")
+	}
+
+	enc, err := vault.EncryptString(plain)
+	if err != nil {
+		log.Fatal(err)
+	}
+	name, _ := cmd.Flags().GetString("name")
+	fmt.Print(formatInlineVault(name, enc))
+}
+
+// formatInlineVault formats an encrypted value as yaml block scalar
+func formatInlineVault(name, enc string) string {
+	indent := "  "
+	s := vault.InlineTag + " |\n"
+	if name != "" {
+		s = name + ": " + s
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(enc, "\n"), "\n") {
+		s += indent + line + "\n"
+	}
+	return s
+}
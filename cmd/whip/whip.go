@@ -37,6 +37,8 @@ func runWhip(cmd *cobra.Command, args []string) {
 	verbosity := setVerbosityLevel(cmd)
 	log.Task("Starting whip", buildVersion)
 	playbookPath := getPlaybookPath(args)
+	vaults := playbook.VaultValues{}
+	extraVars := getExtraVars(cmd, vaults)
 
 	// change working dir to playbook parent
 	// this is where we will look for assets
@@ -44,25 +46,33 @@ func runWhip(cmd *cobra.Command, args []string) {
 		log.Fatal(err)
 	}
 
-	playbookPath = filepath.Base(playbookPath)
-	pb, err := playbook.Load(playbookPath)
-	if err != nil {
-		log.Error(err)
-		return
-	}
+	pb := loadPlaybook(filepath.Base(playbookPath), extraVars, vaults)
 
 	log.Progress("Loaded playbook with", len(*pb), "plays")
 
+	// inline secrets are only needed now, not to load or lint the playbook
+	if err := playbook.Decrypt(pb, vaults); err != nil {
+		log.Fatal(err)
+	}
+
 	// validation... should happen at deputy, because controller doesn't have access
 	// to facts and cannot parse dynamic tasks without them
 
 	runPreRunTasks(pb)
 
-	// TODO load external vars
-
 	// Create jobbook to map plays to targets
-	jobBook := createJobBook(pb)
+	runID := newRunID()
+	jobBook := createJobBook(pb, runID)
+
+	if !runJobBook(jobBook, verbosity) {
+		os.Exit(1)
+	}
+	log.Ok(fmt.Sprintf("Finished whip run %s in %.1fs", runID, time.Since(whipStartTime).Seconds()))
+}
 
+// runJobBook runs the jobs at their targets and reports the results. It
+// returns false if any task or handler failed.
+func runJobBook(jobBook map[model.TargetName]model.Job, verbosity int) bool {
 	stats := map[model.TargetName]map[string]int{}
 
 	resultChan := make(chan model.TaskResult)
@@ -70,7 +80,7 @@ func runWhip(cmd *cobra.Command, args []string) {
 
 	for target, job := range jobBook {
 		// need to save total tasks for progress meter later
-		stats[target] = map[string]int{"total": len(job.Tasks()) + 2} // +1 for loading the deputy
+		stats[target] = map[string]int{"total": countResults(job)}
 
 		wg.Add(1)
 		go func(job model.Job, h model.TargetName, r chan<- model.TaskResult) {
@@ -85,8 +95,33 @@ func runWhip(cmd *cobra.Command, args []string) {
 		close(resultChan)
 	}()
 
-	reportResults(resultChan, stats, verbosity)
-	log.Ok(fmt.Sprintf("Finished whip in %.1fs", time.Since(whipStartTime).Seconds()))
+	return reportResults(resultChan, stats, verbosity)
+}
+
+// countResults returns the number of results that the deputy will send for
+// job: one per task, one per (possibly skipped) handler at the end of a play
+// and at every flush_handlers, plus two for starting and loading the deputy.
+// Auto handlers for names that are only notified at runtime are not counted.
+func countResults(job model.Job) int {
+	total := 2
+	for _, play := range job.Playbook {
+		// all tasks in blocks send a result, also if skipped because
+		// their branch is not taken
+		tasks := model.FlattenTasks(play.Tasks)
+		flushes := 1
+		for _, t := range tasks {
+			if runners.IsFlushHandlers(t) {
+				flushes++
+			}
+		}
+		total += len(tasks) + flushes*(len(play.Handlers)+len(runners.AutoHandlers(play)))
+	}
+	return total
+}
+
+// newRunID returns a timestamp that identifies the backups made during this run
+func newRunID() string {
+	return time.Now().UTC().Format("20060102T150405Z")
 }
 
 func runPlaybookAtHost(job model.Job, t model.TargetName, results chan<- model.TaskResult) {
@@ -110,7 +145,8 @@ func runPlaybookAtHost(job model.Job, t model.TargetName, results chan<- model.T
 	}
 	defer conn.Close()
 
-	if err := ensureDeputy(conn); err != nil {
+	cachedBlobs, err := ensureDeputy(conn)
+	if err != nil {
 		log.Error(err)
 		return
 	}
@@ -124,9 +160,24 @@ func runPlaybookAtHost(job model.Job, t model.TargetName, results chan<- model.T
 	// chain gob encoder and zstd compressor
 	gobRd, gobWr := io.Pipe()
 	go func() {
-		if err := gob.NewEncoder(gobWr).Encode(job); err != nil {
+		enc := gob.NewEncoder(gobWr)
+		if err := enc.Encode(job); err != nil {
 			log.Fatal("gob encode err", err)
 		}
+		// send only the asset contents that the target doesn't have yet,
+		// secrets are always sent as the deputy doesn't keep them
+		files := assets.JobFiles(&job)
+		sent := 0
+		for hash, f := range files {
+			if cachedBlobs[hash] && !f.Secret {
+				continue
+			}
+			if err := assets.SendBlob(enc, f); err != nil {
+				log.Fatal("cannot send asset", f.Source, err)
+			}
+			sent++
+		}
+		log.Debug("Sent", sent, "of", len(files), "asset blobs to", t)
 		gobWr.Close()
 	}()
 
@@ -183,7 +234,7 @@ func runPreRunTasks(pb *model.Playbook) {
 			}
 		}
 
-		for _, task := range play.Tasks {
+		for _, task := range model.FlattenTasks(play.Tasks) {
 			tr := runners.PreRun(&task, play.Vars)
 			if tr.Status == runners.Skipped {
 				continue
@@ -194,13 +245,13 @@ func runPreRunTasks(pb *model.Playbook) {
 }
 
 // Function to create jobBook from playbook
-func createJobBook(pb *model.Playbook) map[model.TargetName]model.Job {
+func createJobBook(pb *model.Playbook, runID string) map[model.TargetName]model.Job {
 	jobBook := map[model.TargetName]model.Job{}
 	for i, play := range *pb {
 		log.Debug("Processing play", i, "with", len(play.Hosts), "hosts")
 		for _, target := range play.Hosts {
 			if _, ok := jobBook[target]; !ok {
-				jobBook[target] = model.Job{}
+				jobBook[target] = model.Job{RunID: runID}
 			}
 			t := jobBook[target]
 			// t.Assets = assets
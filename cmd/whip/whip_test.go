@@ -1 +1,34 @@
 package main
+
+import (
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_countResults(t *testing.T) {
+	job := model.Job{Playbook: model.Playbook{{
+		Tasks: []model.Task{
+			{Runner: "command", Notify: []string{"nginx-reload"}},
+			{Runner: "meta", Args: model.TaskArgs{"_args": "flush_handlers"}},
+			{Runner: "command"},
+		},
+		Handlers: []model.Task{{Name: "php", Runner: "command"}},
+	}}}
+	// 2 for the deputy, 3 tasks, and 2 handlers (one auto) at 2 flushes
+	assert.Equal(t, 9, countResults(job))
+}
+
+func Test_countResultsBlock(t *testing.T) {
+	job := model.Job{Playbook: model.Playbook{{
+		Tasks: []model.Task{
+			{Block: []model.Task{
+				{Runner: "command"},
+				{Block: []model.Task{{Runner: "command"}}, Always: []model.Task{{Runner: "command"}}},
+			}, Rescue: []model.Task{{Runner: "command"}}},
+		},
+	}}}
+	// 2 for the deputy, and every task in every branch
+	assert.Equal(t, 6, countResults(job))
+}
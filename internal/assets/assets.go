@@ -1,13 +1,16 @@
 package assets
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 
+	log "github.com/gwillem/go-simplelog"
 	"github.com/gwillem/whip/internal/model"
 	"github.com/gwillem/whip/internal/vault"
-	"github.com/spf13/afero"
 )
 
 const (
@@ -16,24 +19,72 @@ const (
 
 // DirToAsset converts a directory to an Asset. Because
 // git only preserves +x attributes, we add broad permissions
-// which are then stripped by the umask.
-func DirToAsset(root string) (*model.Asset, error) {
+// which are then stripped by the umask. File contents are not
+// included, only their (decrypted) hash and local source path.
+// Paths matched by .gitignore, .whipignore or the exclude patterns
+// (relative to root) are skipped.
+func DirToAsset(root string, exclude []string) (*model.Asset, error) {
 	asset := model.Asset{Name: root}
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	ancestorRules, err := loadAncestorIgnores(absRoot)
+	if err != nil {
+		return nil, err
+	}
+	rootRules := append(parseIgnoreLines(absRoot, defaultIgnores), ancestorRules...)
+	excludes := parseIgnoreLines(absRoot, exclude)
+
+	// ignore rules per dir, including those of parent dirs
+	dirRules := map[string]ignoreList{}
+	ignoredCount := 0
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
+		absPath := filepath.Join(absRoot, path[len(root):])
+
+		if absPath != absRoot {
+			parentRules := dirRules[filepath.Dir(absPath)]
+			if parentRules.ignored(absPath, info.IsDir()) || excludes.ignored(absPath, info.IsDir()) {
+				ignoredCount++
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if info.IsDir() {
+			local, err := loadIgnoreFiles(absPath)
+			if err != nil {
+				return err
+			}
+			inherited := rootRules
+			if absPath != absRoot {
+				inherited = dirRules[filepath.Dir(absPath)]
+			}
+			dirRules[absPath] = append(slices.Clone(inherited), local...)
+		}
+
 		relPath := path[len(root):]
 		if relPath == "" {
 			return nil
 		}
-		var data []byte
+		f := model.File{Path: relPath}
 
 		if !info.IsDir() {
-			data, err = vault.ReadFile(path)
+			f.Hash, f.Size, err = hashFile(path)
 			if err != nil {
 				return err
 			}
+			if f.Secret, err = vault.IsEncrypted(path); err != nil {
+				return err
+			}
+			f.Source = path
 		}
 
 		// preserve dir and +x attributes
@@ -44,39 +95,32 @@ func DirToAsset(root string) (*model.Asset, error) {
 		if mode&0o100 != 0 {
 			mode |= 0o111
 		}
+		f.Mode = mode
 
-		asset.Files = append(asset.Files, model.File{Path: relPath, Data: data, Mode: mode})
+		asset.Files = append(asset.Files, f)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	log.Debug("Ignored", ignoredCount, "paths in", root)
 	return &asset, nil
 }
 
-// AssetToFS converts a model.Asset to an in-memory filesystem (afero.Fs).
-// It creates directories and files based on the Asset's Files, preserving
-// file modes and content.
-func AssetToFS(asset *model.Asset) (afero.Fs, error) {
-	fs := afero.NewMemMapFs()
-	for _, f := range asset.Files {
-		if f.Mode.IsDir() {
-			if err := fs.MkdirAll(f.Path, f.Mode); err != nil {
-				return nil, err
-			}
-			continue
-		}
-		fh, err := fs.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY, f.Mode)
-		if err != nil {
-			return nil, err
-		}
-		defer fh.Close()
-		_, err = fh.Write(f.Data)
-		if err != nil {
-			return nil, err
-		}
+// hashFile returns the sha256 and size of the decrypted contents of path
+func hashFile(path string) (string, int64, error) {
+	fh, err := vault.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, fh)
+	if err != nil {
+		return "", 0, err
 	}
-	return fs, nil
+	return hex.EncodeToString(h.Sum(nil)), n, nil
 }
 
 type ReadCounter struct {
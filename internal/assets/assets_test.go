@@ -29,7 +29,7 @@ func TestDirToAsset(t *testing.T) {
 	}
 
 	// Call DirToAsset
-	asset, err := DirToAsset(tempDir)
+	asset, err := DirToAsset(tempDir, nil)
 	assert.NoError(t, err)
 	assert.NotNil(t, asset)
 
@@ -41,13 +41,15 @@ func TestDirToAsset(t *testing.T) {
 	for _, file := range asset.Files {
 		switch file.Path {
 		case string(filepath.Separator) + "file1.txt":
-			assert.Equal(t, []byte("content of file1"), file.Data)
+			assert.Equal(t, sha256hex("content of file1"), file.Hash)
+			assert.Equal(t, int64(16), file.Size)
+			assert.Equal(t, filepath.Join(tempDir, "file1.txt"), file.Source)
 			assert.Equal(t, os.FileMode(0o666), file.Mode)
 		case string(filepath.Separator) + "subdir":
-			assert.Empty(t, file.Data)
+			assert.Empty(t, file.Hash)
 			assert.True(t, file.Mode.IsDir())
 		case filepath.Join(string(filepath.Separator)+"subdir", "file2.txt"):
-			assert.Equal(t, []byte("content of file2"), file.Data)
+			assert.Equal(t, sha256hex("content of file2"), file.Hash)
 			assert.Equal(t, os.FileMode(0o666), file.Mode)
 
 		default:
@@ -0,0 +1,216 @@
+package assets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/vault"
+)
+
+// Asset contents are cached at the target by their sha256 hash, so the
+// controller only needs to send the blobs that the deputy lacks. Blobs of
+// vaulted files are removed after the run, as they are decrypted, and
+// blobs that were not used for blobMaxAge are evicted.
+
+// RemoteBlobDir is the blob cache, relative to the home dir of the ssh user
+const RemoteBlobDir = ".cache/whip/blobs"
+
+const (
+	// blobs are sent in chunks, so neither side holds a whole file in memory
+	blobChunkSize = 1 << 20
+	blobMaxAge    = 30 * 24 * time.Hour
+)
+
+var blobDir string
+
+type encoder interface {
+	Encode(any) error
+}
+
+// SetBlobDir sets the local blob cache dir, used by the deputy
+func SetBlobDir(dir string) {
+	blobDir = dir
+}
+
+func validHash(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// BlobPath returns the path of the cached blob for hash
+func BlobPath(hash string) (string, error) {
+	if blobDir == "" {
+		return "", fmt.Errorf("no blob dir set")
+	}
+	if !validHash(hash) {
+		return "", fmt.Errorf("invalid blob hash %q", hash)
+	}
+	return filepath.Join(blobDir, hash), nil
+}
+
+// SendBlob reads the (decrypted) contents of f on the controller and
+// encodes it as a sequence of chunks
+func SendBlob(enc encoder, f model.File) error {
+	fh, err := vault.Open(f.Source)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	buf := make([]byte, blobChunkSize)
+	for {
+		n, err := io.ReadFull(fh, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return err
+		}
+		if e := enc.Encode(model.Blob{Hash: f.Hash, Data: buf[:n], Last: last}); e != nil {
+			return e
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// BlobWriter receives blob chunks on the deputy and writes them to a temp
+// file in the cache. On the last chunk, the contents are verified against
+// the hash and moved into place.
+type BlobWriter struct {
+	hash string
+	tmp  *os.File
+	sum  hash.Hash
+}
+
+func (w *BlobWriter) Write(b model.Blob) error {
+	if w.tmp != nil && w.hash != b.Hash {
+		return fmt.Errorf("blob %s is incomplete", w.hash)
+	}
+	if w.tmp == nil {
+		if _, err := BlobPath(b.Hash); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(blobDir, 0o700); err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(blobDir, "temp_*")
+		if err != nil {
+			return err
+		}
+		w.hash, w.tmp, w.sum = b.Hash, tmp, sha256.New()
+	}
+
+	if _, err := w.tmp.Write(b.Data); err != nil {
+		return err
+	}
+	w.sum.Write(b.Data)
+
+	if !b.Last {
+		return nil
+	}
+	defer w.Close()
+	if hex.EncodeToString(w.sum.Sum(nil)) != w.hash {
+		return fmt.Errorf("checksum mismatch for blob %s", w.hash)
+	}
+	if err := w.tmp.Close(); err != nil {
+		return err
+	}
+	path, _ := BlobPath(w.hash)
+	return os.Rename(w.tmp.Name(), path)
+}
+
+// Close removes any incomplete blob
+func (w *BlobWriter) Close() error {
+	if w.tmp == nil {
+		return nil
+	}
+	_ = w.tmp.Close()
+	_ = os.Remove(w.tmp.Name())
+	w.tmp = nil
+	return nil
+}
+
+// CleanBlobs is called by the deputy after a run with the files of the
+// job. It removes the blobs of secret files, marks the others as used and
+// evicts the blobs (and incomplete temp files) that were not used recently.
+func CleanBlobs(files map[string]model.File) error {
+	if blobDir == "" {
+		return nil
+	}
+	now := time.Now()
+	errs := []error{}
+	for hash, f := range files {
+		path, err := BlobPath(hash)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if f.Secret {
+			err = os.Remove(path)
+		} else {
+			err = os.Chtimes(path, now, now)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+
+	entries, err := os.ReadDir(blobDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		errs = append(errs, err)
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || now.Sub(info.ModTime()) < blobMaxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(blobDir, e.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// JobFiles returns all regular files in the assets of a job, by hash
+func JobFiles(job *model.Job) map[string]model.File {
+	files := map[string]model.File{}
+	for _, play := range job.Playbook {
+		for _, task := range slices.Concat(model.FlattenTasks(play.Tasks), play.Handlers) {
+			for _, f := range TaskFiles(task) {
+				// same contents as a vaulted file, so also secret
+				f.Secret = f.Secret || files[f.Hash].Secret
+				files[f.Hash] = f
+			}
+		}
+	}
+	return files
+}
+
+// TaskFiles returns the regular files in the assets of a task
+func TaskFiles(task model.Task) []model.File {
+	var asset model.Asset
+	switch a := task.Args["_assets"].(type) {
+	case model.Asset:
+		asset = a
+	case *model.Asset:
+		asset = *a
+	default:
+		return nil
+	}
+	files := []model.File{}
+	for _, f := range asset.Files {
+		if !f.Mode.IsDir() {
+			files = append(files, f)
+		}
+	}
+	return files
+}
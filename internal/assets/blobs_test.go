@@ -0,0 +1,131 @@
+package assets
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+type blobCollector []model.Blob
+
+func (bc *blobCollector) Encode(v any) error {
+	b := v.(model.Blob)
+	b.Data = bytes.Clone(b.Data) // SendBlob reuses its buffer
+	*bc = append(*bc, b)
+	return nil
+}
+
+func Test_BlobRoundtrip(t *testing.T) {
+	SetBlobDir(t.TempDir())
+	defer SetBlobDir("")
+
+	// larger than a single chunk
+	content := bytes.Repeat([]byte("0123456789"), blobChunkSize/4)
+
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "big.bin"), content, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "empty"), nil, 0o644))
+
+	asset, err := DirToAsset(src, nil)
+	require.NoError(t, err)
+	job := &model.Job{Playbook: model.Playbook{{
+		Tasks: []model.Task{{Runner: "tree", Args: model.TaskArgs{"_assets": asset}}},
+	}}}
+
+	files := JobFiles(job)
+	require.Len(t, files, 2)
+
+	bw := &BlobWriter{}
+	defer bw.Close()
+	for hash, f := range files {
+		var chunks blobCollector
+		require.NoError(t, SendBlob(&chunks, f))
+		for _, c := range chunks {
+			require.NoError(t, bw.Write(c))
+		}
+
+		path, err := BlobPath(hash)
+		require.NoError(t, err)
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, f.Size, int64(len(data)))
+		require.Equal(t, hash, sha256hex(string(data)))
+	}
+}
+
+func Test_BlobWriterInvalid(t *testing.T) {
+	SetBlobDir(t.TempDir())
+	defer SetBlobDir("")
+
+	bw := &BlobWriter{}
+	defer bw.Close()
+	require.Error(t, bw.Write(model.Blob{Hash: sha256hex("foo"), Data: []byte("bar"), Last: true}))
+	require.Error(t, bw.Write(model.Blob{Hash: "../../etc/passwd", Data: []byte("bar"), Last: true}))
+	_, err := BlobPath("../../etc/passwd")
+	require.Error(t, err)
+
+	entries, err := os.ReadDir(blobDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func Test_CleanBlobs(t *testing.T) {
+	t.Setenv("WHIP_KEY", "AGE-SECRET-KEY-1ATU93PUH73GSD6UXHVU4GYQ2JKM5SJ0SNUH8UWPGCQ0HWYUEL5WQRVYT4V")
+	SetBlobDir(t.TempDir())
+	defer SetBlobDir("")
+
+	src := t.TempDir()
+	vaulted, err := os.ReadFile(testutil.FixturePath("vault/sample.age"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "secret"), vaulted, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(src, "plain"), []byte("plain\n"), 0o644))
+	asset, err := DirToAsset(src, nil)
+	require.NoError(t, err)
+	job := &model.Job{Playbook: model.Playbook{{
+		Tasks: []model.Task{{Runner: "tree", Args: model.TaskArgs{"_assets": asset}}},
+	}}}
+	files := JobFiles(job)
+
+	bw := &BlobWriter{}
+	defer bw.Close()
+	paths := map[string]string{}
+	for hash, f := range files {
+		var chunks blobCollector
+		require.NoError(t, SendBlob(&chunks, f))
+		for _, c := range chunks {
+			require.NoError(t, bw.Write(c))
+		}
+		paths[f.Path], _ = BlobPath(hash)
+		fi, err := os.Stat(paths[f.Path])
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+	}
+	require.True(t, files[sha256hex("hoi\n")].Secret)
+	require.False(t, files[sha256hex("plain\n")].Secret)
+
+	// an old blob of another job
+	old := filepath.Join(blobDir, sha256hex("old"))
+	require.NoError(t, os.WriteFile(old, []byte("old"), 0o600))
+	past := time.Now().Add(-blobMaxAge - time.Hour)
+	require.NoError(t, os.Chtimes(old, past, past))
+	require.NoError(t, os.Chtimes(paths["/plain"], past, past))
+
+	require.NoError(t, CleanBlobs(files))
+	require.NoFileExists(t, paths["/secret"])
+	require.NoFileExists(t, old)
+	// used by this job, so it is kept
+	require.FileExists(t, paths["/plain"])
+}
@@ -0,0 +1,178 @@
+package assets
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Asset dirs can contain .gitignore and .whipignore files, with gitignore
+// semantics: patterns are relative to the dir of the ignore file, the last
+// matching pattern wins and a leading ! re-includes a path.
+
+const whipIgnoreFile = ".whipignore"
+
+var (
+	ignoreFiles    = []string{".gitignore", whipIgnoreFile}
+	defaultIgnores = []string{".git/", ".DS_Store", "*.swp", "*~", whipIgnoreFile}
+)
+
+type ignoreRule struct {
+	base    string // dir of the ignore file
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreList []ignoreRule
+
+// ignored reports whether path is ignored. It should be an absolute path,
+// just like the bases of the rules.
+func (il ignoreList) ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, r := range il {
+		rel, ok := strings.CutPrefix(filepath.ToSlash(path), filepath.ToSlash(r.base)+"/")
+		if !ok || (r.dirOnly && !isDir) {
+			continue
+		}
+		if r.re.MatchString(rel) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+func parseIgnoreLines(base string, lines []string) ignoreList {
+	il := ignoreList{}
+	for _, l := range lines {
+		if r, ok := parseIgnoreRule(base, l); ok {
+			il = append(il, r)
+		}
+	}
+	return il
+}
+
+// loadIgnoreFiles reads the ignore files in dir, if any
+func loadIgnoreFiles(dir string) (ignoreList, error) {
+	il := ignoreList{}
+	for _, name := range ignoreFiles {
+		fh, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		lines := []string{}
+		scanner := bufio.NewScanner(fh)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		fh.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		il = append(il, parseIgnoreLines(dir, lines)...)
+	}
+	return il, nil
+}
+
+// loadAncestorIgnores reads the .gitignore files between the git root and
+// dir (exclusive), so that repo wide patterns also apply to asset dirs.
+func loadAncestorIgnores(dir string) (ignoreList, error) {
+	ancestors := []string{}
+	for d := filepath.Dir(dir); ; d = filepath.Dir(d) {
+		ancestors = append(ancestors, d)
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			break
+		}
+		if d == filepath.Dir(d) {
+			return ignoreList{}, nil // not in a git repo
+		}
+	}
+
+	il := ignoreList{}
+	for i := len(ancestors) - 1; i >= 0; i-- {
+		rules, err := loadIgnoreFiles(ancestors[i])
+		if err != nil {
+			return nil, err
+		}
+		il = append(il, rules...)
+	}
+	return il, nil
+}
+
+func parseIgnoreRule(base, line string) (r ignoreRule, ok bool) {
+	// trailing spaces are ignored, unless escaped
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return r, false
+	}
+
+	r.base = base
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return r, false
+	}
+
+	// patterns with a slash are relative to base, otherwise match at any level
+	prefix := "(?:.*/)?"
+	if strings.Contains(line, "/") {
+		prefix = ""
+		line = strings.TrimPrefix(line, "/")
+	}
+
+	re, err := regexp.Compile("^" + prefix + globToRegexp(line) + "$")
+	if err != nil {
+		return r, false
+	}
+	r.re = re
+	return r, true
+}
+
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			sb.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			sb.WriteString("/.*")
+			i += 2
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(string(glob[i])))
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			sb.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return sb.String()
+}
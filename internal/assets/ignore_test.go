@@ -0,0 +1,84 @@
+package assets
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ignoreRules(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		want    bool
+	}{
+		{"*.log", "/b/app.log", false, true},
+		{"*.log", "/b/sub/app.log", false, true},
+		{"*.log", "/b/app.log.txt", false, false},
+		{"/app.log", "/b/sub/app.log", false, false},
+		{"/app.log", "/b/app.log", false, true},
+		{"build/", "/b/sub/build", true, true},
+		{"build/", "/b/sub/build", false, false},
+		{"sub/build", "/b/sub/build", false, true},
+		{"sub/build", "/b/x/sub/build", false, false},
+		{"**/cache", "/b/x/y/cache", true, true},
+		{"docs/**", "/b/docs/a/b.md", false, true},
+		{"a/**/z", "/b/a/z", false, true},
+		{"a/**/z", "/b/a/x/y/z", false, true},
+		{"file?.txt", "/b/file1.txt", false, true},
+		{"file[0-9].txt", "/b/filex.txt", false, false},
+		{"file[!0-9].txt", "/b/filex.txt", false, true},
+		{`\#notes`, "/b/#notes", false, true},
+		{"# comment", "/b/# comment", false, false},
+	}
+	for _, tt := range tests {
+		il := parseIgnoreLines("/b", []string{tt.pattern})
+		require.Equal(t, tt.want, il.ignored(tt.path, tt.isDir), "%s on %s", tt.pattern, tt.path)
+	}
+
+	il := parseIgnoreLines("/b", []string{"*.conf", "!nginx.conf"})
+	require.True(t, il.ignored("/b/php.conf", false))
+	require.False(t, il.ignored("/b/nginx.conf", false))
+	require.False(t, il.ignored("/other/php.conf", false))
+}
+
+func Test_DirToAssetIgnores(t *testing.T) {
+	root := t.TempDir()
+	for path, content := range map[string]string{
+		".whipignore":          "*.bak\n",
+		".DS_Store":            "",
+		".git/config":          "",
+		"etc/nginx/nginx.conf": "",
+		"etc/nginx/old.bak":    "",
+		"etc/nginx/.nginx.swp": "",
+		"etc/app/.gitignore":   "*.log\n!keep.log\n",
+		"etc/app/debug.log":    "",
+		"etc/app/keep.log":     "",
+		"etc/app/build/out":    "",
+	} {
+		full := filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(full), 0o755))
+		require.NoError(t, os.WriteFile(full, []byte(content), 0o644))
+	}
+
+	asset, err := DirToAsset(root, []string{"build/"})
+	require.NoError(t, err)
+
+	paths := []string{}
+	for _, f := range asset.Files {
+		paths = append(paths, f.Path)
+	}
+	slices.Sort(paths)
+	require.Equal(t, []string{
+		"/etc",
+		"/etc/app",
+		"/etc/app/.gitignore",
+		"/etc/app/keep.log",
+		"/etc/nginx",
+		"/etc/nginx/nginx.conf",
+	}, paths)
+}
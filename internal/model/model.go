@@ -4,6 +4,9 @@ import (
 	"encoding/gob"
 	"fmt"
 	"io/fs"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/barkimedes/go-deepcopy"
@@ -17,6 +20,7 @@ func init() {
 
 type (
 	Job struct {
+		RunID    string   `json:"run_id,omitempty"`
 		Vars     Vars     `json:"vars,omitempty"`
 		Playbook Playbook `json:"playbook,omitempty"`
 		// Assets   *Asset   `json:"assets,omitempty"`
@@ -28,10 +32,21 @@ type (
 		Name  string `json:"name,omitempty"`
 		Files []File `json:"files,omitempty"`
 	}
+	// File refers to its contents by sha256 hash, the contents are streamed
+	// separately as Blobs, and only if the target does not have it yet.
 	File struct {
-		Path string      `json:"path,omitempty"`
-		Data []byte      `json:"data,omitempty"`
-		Mode fs.FileMode `json:"mode,omitempty"`
+		Path   string      `json:"path,omitempty"`
+		Hash   string      `json:"hash,omitempty"`
+		Size   int64       `json:"size,omitempty"`
+		Mode   fs.FileMode `json:"mode,omitempty"`
+		Source string      `json:"source,omitempty"` // local path at controller
+		Secret bool        `json:"secret,omitempty"` // decrypted from a vault, not kept in the blob cache
+	}
+	// Blob is a chunk of file contents, Last marks the final chunk
+	Blob struct {
+		Hash string `json:"hash,omitempty"`
+		Data []byte `json:"data,omitempty"`
+		Last bool   `json:"last,omitempty"`
 	}
 	Playbook []Play
 	Play     struct {
@@ -39,9 +54,11 @@ type (
 		AssetPath string         `json:"assets,omitempty"`
 		Hosts     []TargetName   `json:"hosts,omitempty"`
 		Vars      map[string]any `json:"vars,omitempty"`
+		VarsFiles []string       `json:"vars_files,omitempty" mapstructure:"vars_files"` // merged into Vars on load
 		Tasks     []Task         `json:"tasks,omitempty"`
 		Handlers  []Task         `json:"handlers,omitempty"`
 		PreRun    []string       `json:"prerun,omitempty"`
+		Roles     []string       `json:"roles,omitempty"`
 	}
 	TargetName string
 	Target     struct {
@@ -57,10 +74,35 @@ type (
 		Name   string   `json:"name,omitempty"`
 		Args   TaskArgs `json:"args,omitempty"`
 		Notify []string `json:"notify,omitempty"`
-		Loop   []any    `json:"loop,omitempty"`
+		Listen []string `json:"listen,omitempty"` // topics that trigger a handler
+		Loop   any      `json:"loop,omitempty"`   // list, map or "{{ var }}"
 		Vars   TaskVars `json:"vars,omitempty"`
 		Tags   []string `json:"tags,omitempty"`
 		Unless string   `json:"unless,omitempty"`
+		When   string   `json:"when,omitempty"`
+
+		LoopControl LoopControl `json:"loop_control,omitempty" mapstructure:"loop_control"`
+
+		// a block groups tasks, rescue runs if any of them fails, always runs regardless
+		Block  []Task `json:"block,omitempty"`
+		Rescue []Task `json:"rescue,omitempty"`
+		Always []Task `json:"always,omitempty"`
+
+		// Source is where the task is defined, for problems found after parsing
+		Source *Source `json:"-" mapstructure:"_source"`
+	}
+
+	// Source is a position in a playbook or task file
+	Source struct {
+		File string
+		Line int
+		Col  int
+	}
+
+	// LoopControl names the loop vars, so loops can be nested
+	LoopControl struct {
+		LoopVar  string `json:"loop_var,omitempty" mapstructure:"loop_var"`   // default item
+		IndexVar string `json:"index_var,omitempty" mapstructure:"index_var"` // zero based
 	}
 
 	TaskArgs map[string]any
@@ -68,12 +110,14 @@ type (
 
 	TaskResult struct {
 		Host     TargetName      `json:"target,omitempty"`
+		RunID    string          `json:"run_id,omitempty"`
 		Changed  bool            `json:"changed,omitempty"`
 		Output   string          `json:"output,omitempty"`
 		Status   int             `json:"status_code,omitempty"`
 		Duration time.Duration   `json:"duration,omitempty"`
 		Task     *Task           `json:"task,omitempty"`
 		Notify   map[string]bool `json:"notify,omitempty"`
+		Rescued  bool            `json:"rescued,omitempty"` // failed, but handled by a rescue section
 	}
 	ReportMsg struct {
 		TaskIdx    int
@@ -90,12 +134,30 @@ func init() {
 func (j *Job) Tasks() []Task {
 	tasks := []Task{}
 	for _, play := range j.Playbook {
-		tasks = append(tasks, play.Tasks...)
+		tasks = append(tasks, FlattenTasks(play.Tasks)...)
 		tasks = append(tasks, play.Handlers...)
 	}
 	return tasks
 }
 
+// IsBlock reports whether t groups other tasks, instead of having a runner
+func (t Task) IsBlock() bool {
+	return len(t.Block) > 0
+}
+
+// FlattenTasks returns the tasks with a runner, including those in blocks
+func FlattenTasks(tasks []Task) []Task {
+	flat := []Task{}
+	for _, t := range tasks {
+		if t.IsBlock() {
+			flat = append(flat, FlattenTasks(slices.Concat(t.Block, t.Rescue, t.Always))...)
+		} else {
+			flat = append(flat, t)
+		}
+	}
+	return flat
+}
+
 func (j *Job) String() string {
 	return fmt.Sprintf("Job: %d tasks, %d vars", len(j.Tasks()), len(j.Vars))
 }
@@ -117,6 +179,37 @@ func (ta TaskArgs) String(s string) string {
 	return ""
 }
 
+// Bool returns true for yes/true/1 style values, either as YAML bool or string
+func (ta TaskArgs) Bool(s string) bool {
+	switch v := ta[s].(type) {
+	case bool:
+		return v
+	case string:
+		return slices.Contains([]string{"yes", "true", "on", "1"}, strings.ToLower(v))
+	case int:
+		return v != 0
+	}
+	return false
+}
+
+// Int returns the integer value of an arg, which can be a YAML int or string
+func (ta TaskArgs) Int(s string) (int, error) {
+	switch v := ta[s].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return v, nil
+	case string:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("arg %s is not a number: %s", s, v)
+		}
+		return i, nil
+	default:
+		return 0, fmt.Errorf("arg %s is not a number: %v", s, v)
+	}
+}
+
 func (ta TaskArgs) ToString() string {
 	if len(ta) > 1 {
 		return fmt.Sprintf("%s", map[string]any(ta))
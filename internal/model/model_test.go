@@ -15,3 +15,35 @@ func Test_TaskArgsStringSlice(t *testing.T) {
 	got = ta.StringSlice("names")[0]
 	assert.Equal(t, "foo", got)
 }
+
+func Test_TaskArgsBoolInt(t *testing.T) {
+	ta := TaskArgs{"a": true, "b": "yes", "c": "no", "d": 3600, "e": "60", "f": "soon"}
+	assert.True(t, ta.Bool("a"))
+	assert.True(t, ta.Bool("b"))
+	assert.False(t, ta.Bool("c"))
+	assert.False(t, ta.Bool("missing"))
+
+	i, err := ta.Int("d")
+	assert.NoError(t, err)
+	assert.Equal(t, 3600, i)
+	i, err = ta.Int("e")
+	assert.NoError(t, err)
+	assert.Equal(t, 60, i)
+	_, err = ta.Int("f")
+	assert.Error(t, err)
+}
+
+func Test_FlattenTasks(t *testing.T) {
+	tasks := []Task{
+		{Runner: "command", Name: "a"},
+		{Name: "block", Block: []Task{
+			{Runner: "command", Name: "b"},
+			{Block: []Task{{Runner: "command", Name: "c"}}, Always: []Task{{Runner: "command", Name: "d"}}},
+		}, Rescue: []Task{{Runner: "command", Name: "e"}}},
+	}
+	names := []string{}
+	for _, t := range FlattenTasks(tasks) {
+		names = append(names, t.Name)
+	}
+	assert.Equal(t, []string{"a", "b", "c", "d", "e"}, names)
+}
@@ -13,12 +13,12 @@ const (
 )
 
 // Helper functions for whip + deputy
-// todo, should take quotes into account, plus only take simple x=y pairs
+// todo, only take simple x=y pairs
 func ParseArgString(arg string) model.TaskArgs {
 	kv := map[string]any{}
 
 	baseArgs := []string{}
-	for _, t := range strings.Split(arg, " ") {
+	for _, t := range splitArgs(arg) {
 		if strings.Contains(t, "=") {
 			opt := strings.SplitN(t, "=", 2)
 
@@ -32,10 +32,36 @@ func ParseArgString(arg string) model.TaskArgs {
 	return kv
 }
 
+// splitArgs splits on spaces, except for spaces within single or double
+// quotes, so that validate="nginx -t -c %s" is kept as a single token.
+// Quotes are preserved, so the base args can be passed to a shell as is.
+func splitArgs(s string) []string {
+	tokens := []string{}
+	var quote rune
+	start := 0
+	for i, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			// inside quotes
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ' ':
+			tokens = append(tokens, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(tokens, s[start:])
+}
+
 func unquote(s string) string {
 	if n, e := strconv.Unquote(s); e == nil {
 		return n
 	}
+	if len(s) > 1 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return s[1 : len(s)-1]
+	}
 	return s
 }
 
@@ -0,0 +1,24 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseArgString(t *testing.T) {
+	tests := []struct {
+		in   string
+		want model.TaskArgs
+	}{
+		{"echo hi", model.TaskArgs{DefaultArg: "echo hi"}},
+		{"owner=root group=sys", model.TaskArgs{DefaultArg: "", "owner": "root", "group": "sys"}},
+		{`owner=root validate="nginx -t -c %s"`, model.TaskArgs{DefaultArg: "", "owner": "root", "validate": "nginx -t -c %s"}},
+		{`validate='visudo -cf %s'`, model.TaskArgs{DefaultArg: "", "validate": "visudo -cf %s"}},
+		{`echo "a b" 'c d'`, model.TaskArgs{DefaultArg: `echo "a b" 'c d'`}},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, ParseArgString(tt.in), tt.in)
+	}
+}
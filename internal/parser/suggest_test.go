@@ -0,0 +1,15 @@
+package parser
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Suggest(t *testing.T) {
+	candidates := []string{"shell", "service", "notify", "tags"}
+	assert.Equal(t, `, did you mean "shell"?`, Suggest("shel", candidates))
+	assert.Equal(t, `, did you mean "notify"?`, Suggest("notfy", candidates))
+	assert.Equal(t, `, did you mean "tags"?`, Suggest("Tags", candidates))
+	assert.Equal(t, "", Suggest("kwakaloe", candidates))
+}
@@ -0,0 +1,62 @@
+package playbook
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+	"github.com/gwillem/whip/internal/runners"
+)
+
+// Lint checks the args of all tasks and handlers against the metadata of
+// their runner and returns all problems, at the position of their task
+func Lint(pb *model.Playbook) error {
+	errs := []error{}
+	seen := map[string]bool{}
+	for _, play := range *pb {
+		for _, t := range slices.Concat(model.FlattenTasks(play.Tasks), play.Handlers) {
+			if runners.IsFlushHandlers(t) {
+				continue
+			}
+			err := runners.CheckTask(t)
+			if err == nil {
+				continue
+			}
+			for _, e := range flattenErrors(err) {
+				// looped tasks would report the same problem for every item
+				p := taskProblem(t, fmt.Sprintf("%s: %v", taskLabel(t), e))
+				if !seen[p.Error()] {
+					seen[p.Error()] = true
+					errs = append(errs, p)
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flattenErrors returns the errors in (nested) joined errors
+func flattenErrors(err error) []error {
+	joined, ok := err.(interface{ Unwrap() []error })
+	if !ok {
+		return []error{err}
+	}
+	list := []error{}
+	for _, e := range joined.Unwrap() {
+		list = append(list, flattenErrors(e)...)
+	}
+	return list
+}
+
+// taskLabel identifies a task in lint messages
+func taskLabel(t model.Task) string {
+	if t.Name != "" {
+		return fmt.Sprintf("task %q (%s)", t.Name, t.Runner)
+	}
+	if s, _ := t.Args[parser.DefaultArg].(string); s != "" {
+		return fmt.Sprintf("%s task %q", t.Runner, s)
+	}
+	return t.Runner + " task"
+}
@@ -0,0 +1,189 @@
+package playbook
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+)
+
+/*
+
+A loop runs a task (or block) once for every item of a list:
+
+	- name: add users
+	  user: name={{ item.key }} shell={{ item.value.shell }}
+	  loop: "{{ users }}"
+	  loop_control:
+	    loop_var: item
+	    index_var: idx
+
+A map is looped as a list of {key, value} items, sorted by key. The list can
+come from a var, which is resolved after the play, role and block vars are
+known. Every iteration also gets a "loop" var with index (from 1), index0,
+first, last and length. Blocks and includes can loop too, use loop_var to
+keep the item of the outer loop apart from that of an inner loop.
+
+*/
+
+const defaultLoopVar = "item"
+
+var loopVarRef = regexp.MustCompile(`^\{\{\s*([\w.]+)\s*\}\}$`)
+
+// expandPlaybookLoops takes a playbook and expands any tasks that have a Loop,
+// replacing them with a task per item, each item copied into task.Vars
+func expandPlaybookLoops(pb *model.Playbook) error {
+	for playidx := range *pb {
+		play := &(*pb)[playidx]
+		tasks, err := expandLoops(play.Tasks, play.Vars)
+		if err != nil {
+			return err
+		}
+		play.Tasks = tasks
+	}
+	return nil
+}
+
+func expandLoops(tasks []model.Task, playVars map[string]any) ([]model.Task, error) {
+	expanded := []model.Task{}
+	for _, task := range tasks {
+		if task.Loop == nil {
+			if err := expandBlockLoops(&task, playVars); err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, task)
+			continue
+		}
+
+		items, err := loopItems(task, playVars)
+		if err != nil {
+			return nil, fmt.Errorf("task %q: %w", task.Name, err)
+		}
+		loopVar := task.LoopControl.LoopVar
+		if loopVar == "" {
+			loopVar = defaultLoopVar
+		}
+		for i, item := range items {
+			newTask := task.Clone()
+			newTask.Loop = nil
+			newTask.LoopControl = model.LoopControl{}
+			vars := map[string]any{
+				loopVar: item,
+				"loop": map[string]any{
+					"index":  i + 1,
+					"index0": i,
+					"first":  i == 0,
+					"last":   i == len(items)-1,
+					"length": len(items),
+				},
+			}
+			if iv := task.LoopControl.IndexVar; iv != "" {
+				vars[iv] = i
+			}
+			setLoopVars(&newTask, vars)
+			if err := expandBlockLoops(&newTask, playVars); err != nil {
+				return nil, err
+			}
+			expanded = append(expanded, newTask)
+		}
+	}
+	return expanded, nil
+}
+
+// expandBlockLoops expands the loops in the sections of a block
+func expandBlockLoops(t *model.Task, playVars map[string]any) (err error) {
+	if !t.IsBlock() {
+		return nil
+	}
+	if t.Block, err = expandLoops(t.Block, playVars); err != nil {
+		return err
+	}
+	if t.Rescue, err = expandLoops(t.Rescue, playVars); err != nil {
+		return err
+	}
+	t.Always, err = expandLoops(t.Always, playVars)
+	return err
+}
+
+// setLoopVars sets the loop vars on a task and, as blocks have already
+// passed their vars down, on all tasks in it
+func setLoopVars(t *model.Task, vars map[string]any) {
+	if t.Vars == nil {
+		t.Vars = model.TaskVars{}
+	}
+	maps.Copy(t.Vars, vars)
+	for _, section := range [][]model.Task{t.Block, t.Rescue, t.Always} {
+		for i := range section {
+			setLoopVars(&section[i], vars)
+		}
+	}
+}
+
+// loopItems returns the items of a loop, which is a list, a map or a
+// reference to a var (with the task vars taking precedence)
+func loopItems(t model.Task, playVars map[string]any) ([]any, error) {
+	loop := t.Loop
+	if s, ok := loop.(string); ok {
+		m := loopVarRef.FindStringSubmatch(strings.TrimSpace(s))
+		if m == nil {
+			// a comma separated list
+			return toAnySlice(StringToSliceSep.Split(s, -1)), nil
+		}
+		vars := maps.Clone(playVars)
+		if vars == nil {
+			vars = map[string]any{}
+		}
+		maps.Copy(vars, t.Vars)
+		v, err := lookupVar(vars, m[1])
+		if err != nil {
+			return nil, fmt.Errorf("loop: %w", err)
+		}
+		loop = v
+	}
+
+	switch l := loop.(type) {
+	case []any:
+		return l, nil
+	case map[string]any:
+		keys := []string{}
+		for k := range l {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		items := []any{}
+		for _, k := range keys {
+			items = append(items, map[string]any{"key": k, "value": l[k]})
+		}
+		return items, nil
+	case nil:
+		return []any{}, nil
+	default:
+		return nil, fmt.Errorf("loop should be a list, a map or a var, not %T", loop)
+	}
+}
+
+// lookupVar returns the value of a dotted var path, such as users.admins
+func lookupVar(vars map[string]any, path string) (any, error) {
+	var v any = vars
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("var %s is not a map at %s", path, key)
+		}
+		if v, ok = m[key]; !ok {
+			return nil, fmt.Errorf("var %s is not defined", path)
+		}
+	}
+	return v, nil
+}
+
+func toAnySlice(s []string) []any {
+	items := []any{}
+	for _, v := range s {
+		items = append(items, v)
+	}
+	return items
+}
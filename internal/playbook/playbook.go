@@ -1,19 +1,19 @@
 package playbook
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"maps"
+	"path/filepath"
 	"reflect"
 	"regexp"
 
-	log "github.com/gwillem/go-simplelog"
 	"github.com/gwillem/whip/internal/model"
 	"github.com/gwillem/whip/internal/parser"
 	"github.com/gwillem/whip/internal/runners"
 	"github.com/mitchellh/mapstructure"
 
 	"golang.org/x/exp/slices"
-	"gopkg.in/yaml.v3"
 )
 
 const (
@@ -22,34 +22,98 @@ const (
 
 var StringToSliceSep = regexp.MustCompile(`,\s*`)
 
+// Load loads and validates a playbook, see LoadWithVars
 func Load(path string) (*model.Playbook, error) {
-	rawData, err := os.ReadFile(path)
+	return LoadWithVars(path, nil, nil)
+}
+
+// LoadWithVars loads and validates a playbook, with its roles, includes and
+// vars files. The extra vars take precedence over all other vars, see vars.go.
+// The inline !vault values are added to vaults, for Decrypt.
+func LoadWithVars(path string, extraVars map[string]any, vaults VaultValues) (*model.Playbook, error) {
+	node, v, err := readYAML(path, vaults)
 	if err != nil {
 		return nil, err
 	}
+	v.playbook(node)
+	if err := v.result(); err != nil {
+		return nil, err
+	}
 
 	var anyMap interface{}
-	if e := yaml.Unmarshal(rawData, &anyMap); e != nil {
+	if e := node.Decode(&anyMap); e != nil {
 		return nil, e
 	}
+	v.playSources(node, anyMap)
+
+	dir := filepath.Dir(path)
+	if err := resolvePlayIncludes(anyMap, dir, vaults); err != nil {
+		return nil, err
+	}
 
 	pb, err := yamlToPlaybook(anyMap)
 	if err != nil {
-		return nil, fmt.Errorf("yaml error: %w", err)
+		return nil, fmt.Errorf("%s: yaml error: %w", path, err)
+	}
+
+	for i := range *pb {
+		if err := loadVarsFiles(&(*pb)[i], dir, vaults); err != nil {
+			return nil, err
+		}
+		if err := loadRoles(&(*pb)[i], dir, vaults); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range *pb {
+		if err := inheritBlocks((*pb)[i].Tasks); err != nil {
+			return nil, err
+		}
+		applyExtraVars(&(*pb)[i], extraVars)
+	}
+	if err := expandPlaybookLoops(pb); err != nil {
+		return nil, err
 	}
 
-	expandPlaybookLoops(pb)
+	if err := validateHandlers(pb); err != nil {
+		return nil, err
+	}
 	return pb, nil
 }
 
+// validateHandlers checks that every notify refers to a handler
+func validateHandlers(pb *model.Playbook) error {
+	errs := []error{}
+	for _, play := range *pb {
+		err := runners.ValidateHandlers(play)
+		if err == nil {
+			continue
+		}
+		for _, e := range flattenErrors(err) {
+			if he, ok := e.(*runners.UnknownHandlerError); ok {
+				e = taskProblem(he.Task, he.Error())
+			}
+			errs = append(errs, e)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func yamlToPlaybook(y any) (*model.Playbook, error) {
 	pb := model.Playbook{}
-	md := mapstructure.Metadata{}
+	if err := decode(y, &pb); err != nil {
+		return nil, err
+	}
+	return &pb, nil
+}
 
+// decode decodes raw yaml data into result, which is a playbook or a list
+// of tasks, such as those of a role. Unknown keys have already been reported
+// by the validator, with their position.
+func decode(y any, result any) error {
 	config := &mapstructure.DecoderConfig{
 		WeaklyTypedInput: true,
-		Result:           &pb,
-		Metadata:         &md,
+		Result:           result,
 		DecodeHook: mapstructure.ComposeDecodeHookFunc(
 			parseTasksFunc(),
 			parseStringToSlice(),
@@ -58,18 +122,10 @@ func yamlToPlaybook(y any) (*model.Playbook, error) {
 
 	decoder, err := mapstructure.NewDecoder(config)
 	if err != nil {
-		return nil, err
-	}
-
-	err = decoder.Decode(y)
-	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if len(md.Unused) > 0 {
-		log.Warn("Unused fields from playbook source:", md.Unused)
-	}
-	return &pb, nil
+	return decoder.Decode(y)
 }
 
 func parseTasksFunc() mapstructure.DecodeHookFunc {
@@ -100,8 +156,12 @@ func parseTasksFunc() mapstructure.DecodeHookFunc {
 			// this is the value of the runner argument, so "shell: echo hello"
 			switch v := v.(type) {
 			case string:
-				// specificArgs[parser.DefaultArg] = v // no x=y pairs
-				specificArgs = parser.ParseArgString(v)
+				if runners.FreeForm(k) {
+					// keep "echo a=b" as is
+					specificArgs = map[string]any{parser.DefaultArg: v}
+				} else {
+					specificArgs = parser.ParseArgString(v)
+				}
 			case map[string]any:
 				specificArgs = v
 			default:
@@ -138,24 +198,53 @@ func parseStringToSlice() mapstructure.DecodeHookFunc {
 	}
 }
 
-// expandPlaybookLoops takes a playbook and expands any tasks that have a Loop,
-// replacing them with multiple tasks, each loop item copied into task.Vars
-func expandPlaybookLoops(pb *model.Playbook) {
-	for playidx := range *pb {
-		play := &(*pb)[playidx]
-		for i := len(play.Tasks) - 1; i >= 0; i-- { // reverse range, because we are expanding the slice in place
-			if loops := play.Tasks[i].Loop; loops != nil {
-				newTasks := []model.Task{}
-				for _, l := range loops {
-					newTask := play.Tasks[i].Clone()
-					newTask.Vars["item"] = l
-					newTask.Loop = nil
-					newTasks = append(newTasks, newTask)
+// inheritBlocks pushes the tags, when and vars of blocks down to the tasks
+// in their block, rescue and always sections, so that the deputy can treat
+// them like any other task
+func inheritBlocks(tasks []model.Task) error {
+	for i := range tasks {
+		b := &tasks[i]
+		if !b.IsBlock() {
+			if len(b.Rescue)+len(b.Always) > 0 {
+				return fmt.Errorf("task %q has rescue or always, but no block", b.Name)
+			}
+			continue
+		}
+		if b.Runner != "" {
+			return fmt.Errorf("block %q cannot have a runner (%s)", b.Name, b.Runner)
+		}
+
+		for _, section := range [][]model.Task{b.Block, b.Rescue, b.Always} {
+			for j := range section {
+				t := &section[j]
+				for _, tag := range b.Tags {
+					if !slices.Contains(t.Tags, tag) {
+						t.Tags = append(t.Tags, tag)
+					}
 				}
-				// remove this task from the playbook
-				// and insert len(Loop) new tasks in its place
-				play.Tasks = slices.Replace(play.Tasks, i, i+1, newTasks...)
+				t.When = joinWhen(b.When, t.When)
+				vars := maps.Clone(b.Vars)
+				if vars == nil {
+					vars = model.TaskVars{}
+				}
+				maps.Copy(vars, t.Vars)
+				t.Vars = vars
+			}
+			if err := inheritBlocks(section); err != nil {
+				return err
 			}
 		}
 	}
+	return nil
+}
+
+// joinWhen combines the conditions of a block and its task
+func joinWhen(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return "(" + a + ") and (" + b + ")"
 }
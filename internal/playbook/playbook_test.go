@@ -1,18 +1,23 @@
 package playbook
 
 import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"slices"
 	"testing"
 
 	log "github.com/gwillem/go-simplelog"
 	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/runners"
 	tu "github.com/gwillem/whip/internal/testutil"
-	"github.com/mitchellh/mapstructure"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func Test_LoadPlaybookSimple1(t *testing.T) {
-	pb, err := Load(tu.FixturePath("playbook/simple.yml"))
+	path := tu.FixturePath("playbook/simple.yml")
+	pb, err := Load(path)
 	assert.NoError(t, err)
 	want := &model.Playbook{
 		model.Play{
@@ -28,13 +33,15 @@ func Test_LoadPlaybookSimple1(t *testing.T) {
 					},
 					Notify: []string{"nginx", "systemd"},
 					Loop:   nil,
+					Source: &model.Source{File: path, Line: 4, Col: 7},
 				},
 				{
 					Runner: "command",
 					Args: model.TaskArgs{
-						"_args":  "update-locale a=b",
-						"unless": "echo $LANG | grep C.UTF-8",
+						"_args": "update-locale LANG=C.UTF-8",
 					},
+					Unless: "echo $LANG | grep C.UTF-8",
+					Source: &model.Source{File: path, Line: 7, Col: 7},
 				},
 			},
 			Handlers: []model.Task{
@@ -44,7 +51,9 @@ func Test_LoadPlaybookSimple1(t *testing.T) {
 					Args: model.TaskArgs{
 						"_args": "echo restarting nginx",
 					},
-					Loop: nil,
+					Listen: []string{"systemd"},
+					Loop:   nil,
+					Source: &model.Source{File: path, Line: 10, Col: 7},
 				},
 			},
 		},
@@ -57,39 +66,51 @@ func Test_LoadPlaybookSimple1(t *testing.T) {
 
 func Test_ExpandTaskLoops(t *testing.T) {
 	defer log.Silence(log.Silence(true))
-	pb, err := Load(tu.FixturePath("playbook/task_loop.yml"))
+	path := tu.FixturePath("playbook/task_loop.yml")
+	pb, err := Load(path)
 	assert.NoError(t, err)
+	src := &model.Source{File: path, Line: 6, Col: 7}
 	want := &model.Playbook{
 		model.Play{
 			Hosts: []model.TargetName{
-				"ubuntu@192.168.64.16",
+				"root@192.168.64.16",
 			},
 			Tasks: []model.Task{
 				{
-					Runner: "command",
+					Runner: "shell",
 					Name:   "install ssh keys",
 					Args: model.TaskArgs{
-						"key":  "{{item}}",
-						"user": "ubuntu",
+						"_args": `echo "{{item}}" >> /home/ubuntu/.ssh/authorized_keys`,
 					},
 					Vars: map[string]any{
 						"item": "abc",
+						"loop": map[string]any{"index": 1, "index0": 0, "first": true, "last": false, "length": 2},
 					},
 					Tags:   []string{},
 					Notify: []string{},
+					Listen: []string{},
+					Block:  []model.Task{},
+					Rescue: []model.Task{},
+					Always: []model.Task{},
+					Source: src,
 				},
 				{
-					Runner: "command",
+					Runner: "shell",
 					Name:   "install ssh keys",
 					Args: model.TaskArgs{
-						"key":  "{{item}}",
-						"user": "ubuntu",
+						"_args": `echo "{{item}}" >> /home/ubuntu/.ssh/authorized_keys`,
 					},
 					Vars: map[string]any{
 						"item": "xyz",
+						"loop": map[string]any{"index": 2, "index0": 1, "first": false, "last": true, "length": 2},
 					},
 					Tags:   []string{},
 					Notify: []string{},
+					Listen: []string{},
+					Block:  []model.Task{},
+					Rescue: []model.Task{},
+					Always: []model.Task{},
+					Source: src,
 				},
 			},
 		},
@@ -105,8 +126,24 @@ func Test_FilesWithMeta(t *testing.T) {
 func Test_DuplicateRunner(t *testing.T) {
 	_, err := Load(tu.FixturePath("playbook/duplicate_runner.yml"))
 	require.Error(t, err)
-	var e *mapstructure.Error
-	assert.ErrorAs(t, err, &e)
+	var p *Problem
+	require.ErrorAs(t, err, &p)
+	assert.Equal(t, 10, p.Line)
+	assert.Equal(t, 7, p.Col)
+	assert.Contains(t, p.Msg, "multiple runners (command and shell)")
+}
+
+func Test_Problems(t *testing.T) {
+	defer log.Silence(log.Silence(true))
+	path := tu.FixturePath("playbook/typos.yml")
+	_, err := Load(path)
+	require.Error(t, err)
+	assert.Equal(t, path+`:5:7: unknown runner or task key "shel", did you mean "shell"?
+    5 |       shel: echo hi
+      |       ^
+`+path+`:7:16: unexpected type for command args, should be a string or a map
+    7 |       command: [echo, hi]
+      |                ^`, err.Error())
 }
 
 func Test_TaskArgList(t *testing.T) {
@@ -127,3 +164,327 @@ func Test_TaskArgs(t *testing.T) {
 	require.Equal(t, "/bin/true", play.Tasks[0].Unless)
 	require.Equal(t, "echo hi", play.Tasks[0].Args.String("_args"))
 }
+
+func Test_UnknownHandler(t *testing.T) {
+	_, err := Load(tu.FixturePath("playbook/unknown_handler.yml"))
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`4:7: task "install nginx config" notifies unknown handler "missing"`,
+		`8:7: task "migrate" notifies unknown handler "app"`,
+	}, problemLines(t, err))
+	assert.Contains(t, err.Error(), "    8 |     - name: migrate\n")
+}
+
+// problemLines returns the problems in err as "line:col: msg"
+func problemLines(t *testing.T, err error) []string {
+	lines := []string{}
+	for _, e := range flattenErrors(err) {
+		p, ok := e.(*Problem)
+		require.True(t, ok, "%v has no position", e)
+		lines = append(lines, fmt.Sprintf("%d:%d: %s", p.Line, p.Col, p.Msg))
+	}
+	return lines
+}
+
+func Test_Block(t *testing.T) {
+	pb, err := Load(tu.FixturePath("playbook/block.yml"))
+	require.NoError(t, err)
+	tasks := model.FlattenTasks((*pb)[0].Tasks)
+	require.Len(t, tasks, 5)
+
+	// block attributes are inherited, nested blocks combine them
+	assert.Equal(t, "/srv/{{app}}/migrate", tasks[0].Args.String("_args"))
+	assert.Equal(t, "env == 'prod'", tasks[0].When)
+	assert.Equal(t, []string{"deploy"}, tasks[0].Tags)
+	assert.Equal(t, "shop", tasks[0].Vars["app"])
+
+	for i, item := range []int{1, 2} {
+		task := tasks[1+i]
+		assert.Equal(t, "(env == 'prod') and (workers)", task.When)
+		assert.Equal(t, []string{"workers", "deploy"}, task.Tags)
+		assert.Equal(t, "worker", task.Vars["app"])
+		assert.Equal(t, item, task.Vars["item"])
+	}
+
+	assert.Equal(t, "/srv/{{app}}/rollback", tasks[3].Args.String("_args"))
+	assert.Equal(t, "shop", tasks[3].Vars["app"])
+	assert.Equal(t, "/srv/{{app}}/notify", tasks[4].Args.String("_args"))
+}
+
+func Test_Roles(t *testing.T) {
+	pb, err := Load(tu.FixturePath("playbook/roles.yml"))
+	require.NoError(t, err)
+	play := (*pb)[0]
+
+	tasks := model.FlattenTasks(play.Tasks)
+	names := []string{}
+	for _, task := range tasks {
+		names = append(names, task.Name)
+	}
+	assert.Equal(t, []string{"install nginx", "nginx config", "motd"}, names)
+
+	// tree src is relative to the role dir
+	assert.Equal(t, tu.FixturePath("playbook/roles/nginx/files"), tasks[1].Args.String("src"))
+
+	// included tasks inherit from the include
+	assert.Equal(t, []string{"common"}, tasks[2].Tags)
+	assert.Equal(t, "motd", tasks[2].When)
+
+	// tasks keep their position, also in roles and included files
+	assert.Equal(t, tu.FixturePath("playbook/roles/nginx/tasks/main.yml"), tasks[0].Source.File)
+	assert.Equal(t, tu.FixturePath("playbook/include/common.yml"), tasks[2].Source.File)
+
+	require.Len(t, play.Handlers, 1)
+	assert.Equal(t, "nginx", play.Handlers[0].Name)
+
+	// play vars take precedence over role defaults
+	assert.Equal(t, 4, play.Vars["worker_processes"])
+	assert.Equal(t, "www-data", play.Vars["nginx_user"])
+}
+
+func Test_UnknownRole(t *testing.T) {
+	err := loadRoles(&model.Play{Roles: []string{"missing"}}, tu.FixturePath("playbook"), nil)
+	require.ErrorContains(t, err, "role missing not found")
+}
+
+func Test_setRoleFileArgs(t *testing.T) {
+	tasks := []model.Task{
+		{Runner: "tree", Args: model.TaskArgs{"src": "files"}},
+		{Runner: "tree", Args: model.TaskArgs{"src": "/srv/files"}},
+		{Runner: "tree", Args: model.TaskArgs{"src": []any{"files"}}},
+		{Block: []model.Task{{Runner: "systemd_unit", Args: model.TaskArgs{"template": map[string]any{"a": "b"}}}}},
+	}
+	// the wrong types are left to CheckTask
+	assert.NotPanics(t, func() { setRoleFileArgs(tasks, "/roles/nginx") })
+	assert.Equal(t, "/roles/nginx/files", tasks[0].Args["src"])
+	assert.Equal(t, "/srv/files", tasks[1].Args["src"])
+	assert.Equal(t, []any{"files"}, tasks[2].Args["src"])
+	assert.Equal(t, map[string]any{"a": "b"}, tasks[3].Block[0].Args["template"])
+}
+
+func Test_LoopExtensions(t *testing.T) {
+	pb, err := Load(tu.FixturePath("playbook/loops.yml"))
+	require.NoError(t, err)
+	tasks := model.FlattenTasks((*pb)[0].Tasks)
+	require.Len(t, tasks, 6)
+
+	// a map is looped as key/value items, sorted by key
+	assert.Equal(t, map[string]any{"key": "alice", "value": map[string]any{"shell": "/bin/zsh"}}, tasks[0].Vars["item"])
+	assert.Equal(t, "bob", tasks[1].Vars["item"].(map[string]any)["key"])
+
+	// nested loops keep their own loop var
+	got := []string{}
+	for _, task := range tasks[2:] {
+		got = append(got, fmt.Sprintf("%v %v %v", task.Vars["user"], task.Vars["idx"], task.Vars["item"]))
+	}
+	assert.Equal(t, []string{"alice 0 key1", "alice 0 key2", "bob 1 key1", "bob 1 key2"}, got)
+
+	loop := tasks[5].Vars["loop"].(map[string]any)
+	assert.Equal(t, 2, loop["index"])
+	assert.Equal(t, true, loop["last"])
+	assert.Equal(t, false, loop["first"])
+}
+
+func Test_loopItems(t *testing.T) {
+	vars := map[string]any{"list": []any{1, 2}, "nested": map[string]any{"list": []any{3}}}
+	tests := []struct {
+		loop any
+		want []any
+		err  bool
+	}{
+		{[]any{"a"}, []any{"a"}, false},
+		{"a, b", []any{"a", "b"}, false},
+		{"{{ list }}", []any{1, 2}, false},
+		{"{{nested.list}}", []any{3}, false},
+		{"{{ missing }}", nil, true},
+		{42, nil, true},
+	}
+	for _, tc := range tests {
+		got, err := loopItems(model.Task{Loop: tc.loop}, vars)
+		if tc.err {
+			assert.Error(t, err, tc.loop)
+			continue
+		}
+		require.NoError(t, err, tc.loop)
+		assert.Equal(t, tc.want, got, tc.loop)
+	}
+}
+
+func Test_Lint(t *testing.T) {
+	pb, err := Load(tu.FixturePath("playbook/lint.yml"))
+	require.NoError(t, err)
+	err = Lint(pb)
+	require.Error(t, err)
+	assert.Equal(t, []string{
+		`4:7: task "install nginx" (apt): arg state should be one of present|latest|absent|purged, not "instaled"`,
+		`4:7: task "install nginx" (apt): arg update_cache should be a bool, not maybe`,
+		`9:7: task "config" (tree): cannot parse octal mode 999`,
+		`9:7: task "config" (tree): unknown arg "etc/nginx", path prefixes should be absolute`,
+		`14:7: service task: unknown arg "enabeld", did you mean "enabled"?`,
+		`16:7: task "unit" (systemd_unit): args unit and template cannot be combined`,
+	}, problemLines(t, err))
+
+}
+
+// Test_LintFixtures checks that every valid fixture loads and lints clean
+func Test_LintFixtures(t *testing.T) {
+	t.Setenv("WHIP_KEY", ageTestKey)
+	invalid := []string{"ansible.yml", "duplicate_runner.yml", "lint.yml", "typos.yml", "unknown_handler.yml"}
+	files, err := filepath.Glob(tu.FixturePath("playbook/*.yml"))
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, path := range files {
+		if slices.Contains(invalid, filepath.Base(path)) {
+			continue
+		}
+		pb, err := Load(path)
+		require.NoError(t, err, path)
+		assert.NoError(t, Lint(pb), path)
+	}
+}
+
+func Test_FreeFormArgs(t *testing.T) {
+	tasks, err := ParseTasks("tasks.yml", []byte("- shell: echo a=b > /tmp/x\n- command: update-locale LANG=C.UTF-8\n"))
+	require.NoError(t, err)
+	assert.Equal(t, model.TaskArgs{"_args": "echo a=b > /tmp/x"}, tasks[0].Args)
+	assert.Equal(t, model.TaskArgs{"_args": "update-locale LANG=C.UTF-8"}, tasks[1].Args)
+	for _, task := range tasks {
+		assert.NoError(t, runners.CheckTask(task))
+	}
+
+	// key=value pairs are still args for the other runners
+	tasks, err = ParseTasks("tasks.yml", []byte("- service: name=nginx state=started\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "nginx", tasks[0].Args.String("name"))
+
+	_, err = ParseTasks("tasks.yml", []byte("- command:\n    _args: update-locale\n    unless: locale | grep C.UTF-8\n"))
+	assert.ErrorContains(t, err, "tasks.yml:3:5: unless is a task key, it should be next to command, not in its args")
+}
+
+func Test_RunnerExamples(t *testing.T) {
+	for _, name := range runners.All() {
+		meta, _ := runners.Meta(name)
+		require.NotEmpty(t, meta.Examples, name)
+		require.NotEmpty(t, meta.Desc, name)
+		for _, example := range meta.Examples {
+			tasks, err := ParseTasks(name+" example", []byte(example))
+			require.NoError(t, err, name)
+			require.NotEmpty(t, tasks, name)
+			for _, task := range tasks {
+				assert.Equal(t, name, task.Runner)
+				assert.NoError(t, runners.CheckTask(task), name)
+			}
+		}
+	}
+}
+
+func Test_Schema(t *testing.T) {
+	defs := Schema()["definitions"].(map[string]any)
+	play := defs["play"].(map[string]any)["properties"].(map[string]any)
+	for _, key := range playKeys {
+		assert.Contains(t, play, key)
+	}
+	task := defs["task"].(map[string]any)["properties"].(map[string]any)
+	for _, key := range slices.Concat(taskKeys, runners.All()) {
+		if key != "runner" {
+			assert.Contains(t, task, key)
+		}
+	}
+
+	// free-form runners take a string, others a string or a map with args
+	assert.Equal(t, "string", task["shell"].(map[string]any)["type"])
+	apt := task["apt"].(map[string]any)["anyOf"].([]any)[1].(map[string]any)
+	assert.Equal(t, false, apt["additionalProperties"])
+	state := apt["properties"].(map[string]any)["state"].(map[string]any)
+	assert.Equal(t, []string{"present", "latest", "absent", "purged"}, state["anyOf"].([]any)[0].(map[string]any)["enum"])
+
+	unit := task["systemd_unit"].(map[string]any)["anyOf"].([]any)[1].(map[string]any)
+	assert.Equal(t, []any{map[string]any{"not": map[string]any{"required": []string{"unit", "template"}}}}, unit["allOf"])
+
+	tree := task["tree"].(map[string]any)["anyOf"].([]any)[1].(map[string]any)
+	prefix := tree["patternProperties"].(map[string]any)["^/"].(map[string]any)
+	re := regexp.MustCompile(prefix["pattern"].(string))
+	assert.True(t, re.MatchString(`notify=nginx-reload validate="nginx -t -c %s"`))
+	assert.True(t, re.MatchString(`owner=www-data group=www-data mode=0640`))
+	assert.False(t, re.MatchString(`ownr=www-data`))
+	assert.False(t, re.MatchString(`www-data`))
+}
+
+// ageTestKey decrypts fixture/playbook/vars/secrets.yml
+const ageTestKey = "AGE-SECRET-KEY-1ATU93PUH73GSD6UXHVU4GYQ2JKM5SJ0SNUH8UWPGCQ0HWYUEL5WQRVYT4V"
+
+func Test_VarsFiles(t *testing.T) {
+	t.Setenv("WHIP_KEY", ageTestKey)
+	path := tu.FixturePath("playbook/vars_files.yml")
+
+	pb, err := Load(path)
+	require.NoError(t, err)
+	play := (*pb)[0]
+	// vars files take precedence over play vars
+	assert.Equal(t, "prod", play.Vars["env"])
+	assert.Equal(t, "www-data", play.Vars["user"])
+	assert.Equal(t, map[string]any{"host": "db1"}, play.Vars["db"])
+	assert.Equal(t, "s3cret", play.Vars["db_password"])
+	assert.Equal(t, "deploy", play.Tasks[0].Vars["user"])
+	require.Len(t, play.Tasks, 3)
+
+	// extra vars take precedence over all, also task vars and loop sources
+	pb, err = LoadWithVars(path, map[string]any{"env": "staging", "user": "root", "users": []any{"carol"}}, nil)
+	require.NoError(t, err)
+	play = (*pb)[0]
+	assert.Equal(t, "staging", play.Vars["env"])
+	assert.Equal(t, "root", play.Vars["user"])
+	assert.Equal(t, "root", play.Tasks[0].Vars["user"])
+	require.Len(t, play.Tasks, 2)
+	assert.Equal(t, "carol", play.Tasks[1].Vars["item"])
+}
+
+func Test_ParseExtraVars(t *testing.T) {
+	vars, err := ParseExtraVars([]string{
+		"env=prod user=root",
+		"@" + tu.FixturePath("playbook/vars/common.json"),
+		`{"user": "deploy", "ports": [80, 443]}`,
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"env":   "prod",
+		"user":  "deploy",
+		"users": []any{"alice", "bob"},
+		"db":    map[string]any{"host": "db1"},
+		"ports": []any{80, 443},
+	}, vars)
+
+	_, err = ParseExtraVars([]string{"prod"}, nil)
+	assert.EqualError(t, err, `extra var "prod" should be key=value or @file`)
+	_, err = ParseExtraVars([]string{"@/does/not/exist.yml"}, nil)
+	assert.Error(t, err)
+}
+
+func Test_VaultInline(t *testing.T) {
+	vaults := VaultValues{}
+	pb, err := LoadWithVars(tu.FixturePath("playbook/vault_inline.yml"), nil, vaults)
+	require.NoError(t, err)
+	play := (*pb)[0]
+	// decrypted when run, so loading and linting doesn't need the key
+	assert.Contains(t, play.Vars["db_password"], "-----BEGIN AGE ENCRYPTED FILE-----")
+	require.NoError(t, Lint(pb))
+
+	t.Setenv("WHIP_KEY", ageTestKey)
+	// without the vault values of the load, nothing is decrypted
+	require.NoError(t, Decrypt(pb, VaultValues{}))
+	assert.Contains(t, play.Vars["db_password"], "-----BEGIN AGE ENCRYPTED FILE-----")
+
+	require.NoError(t, Decrypt(pb, vaults))
+	assert.Equal(t, "s3cret", play.Vars["db_password"])
+	assert.Equal(t, "abc123", play.Vars["api_key"])
+	assert.Equal(t, "prod", play.Vars["app_env"])
+	assert.Equal(t, "hunter2", play.Tasks[0].Vars["item"].(map[string]any)["password"])
+	assert.Equal(t, "plain", play.Tasks[1].Vars["item"].(map[string]any)["password"])
+	// handler loops are not expanded, but their items are decrypted too
+	assert.Equal(t, []any{"carol"}, play.Handlers[0].Loop)
+	// only values with a !vault tag are decrypted
+	assert.Contains(t, play.Vars["armored"], "-----BEGIN AGE ENCRYPTED FILE-----")
+
+	_, err = ParseTasks("plain.yml", []byte("- shell: echo hi\n  vars:\n    password: !vault hunter2\n"))
+	assert.ErrorContains(t, err, `plain.yml:3:15: !vault value is not encrypted, use "whip vault encrypt-string"`)
+}
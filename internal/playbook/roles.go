@@ -0,0 +1,251 @@
+package playbook
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+
+Roles are reusable sets of tasks, in the roles dir next to the playbook:
+
+	.whip/roles/nginx/
+	    tasks/main.yml      tasks, prepended to those of the play
+	    handlers/main.yml   handlers, added to those of the play
+	    defaults/main.yml   vars, overridden by the play vars
+	    files/              assets, tree src is relative to the role dir
+
+A task list can include another task file with "include_tasks: file.yml",
+relative to the including file. The include is treated as a block, so it
+can have tags, when and vars.
+
+*/
+
+const (
+	rolesDir        = "roles"
+	maxIncludeDepth = 10
+)
+
+// roleFileArgs are the args with controller paths per runner, that are
+// relative to the role dir when used in a role
+var roleFileArgs = map[string][]string{
+	"tree":         {"src"},
+	"systemd_unit": {"template"},
+	"pip":          {"requirements"},
+}
+
+// resolvePlayIncludes replaces include_tasks in the tasks of all plays
+func resolvePlayIncludes(raw any, dir string, vaults VaultValues) error {
+	plays, ok := raw.([]any)
+	if !ok {
+		return nil // let the decoder complain
+	}
+	for _, p := range plays {
+		play, ok := p.(map[string]any)
+		if !ok || play["tasks"] == nil {
+			continue
+		}
+		tasks, err := resolveIncludes(play["tasks"], dir, 0, vaults)
+		if err != nil {
+			return err
+		}
+		play["tasks"] = tasks
+	}
+	return nil
+}
+
+// resolveIncludes turns every include_tasks in a raw task list into a block
+// with the tasks of that file, which is relative to dir
+func resolveIncludes(raw any, dir string, depth int, vaults VaultValues) (any, error) {
+	tasks, ok := raw.([]any)
+	if !ok {
+		return raw, nil
+	}
+	if depth > maxIncludeDepth {
+		return nil, fmt.Errorf("include_tasks nested more than %d levels, is there a loop?", maxIncludeDepth)
+	}
+	for _, t := range tasks {
+		task, ok := t.(map[string]any)
+		if !ok {
+			continue
+		}
+		for _, section := range []string{"block", "rescue", "always"} {
+			if task[section] == nil {
+				continue
+			}
+			resolved, err := resolveIncludes(task[section], dir, depth, vaults)
+			if err != nil {
+				return nil, err
+			}
+			task[section] = resolved
+		}
+
+		include, ok := task["include_tasks"].(string)
+		if !ok {
+			continue
+		}
+		if task["block"] != nil {
+			return nil, fmt.Errorf("include_tasks %s cannot have a block", include)
+		}
+		path := include
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		included, err := readTaskFile(path, vaults)
+		if err != nil {
+			return nil, fmt.Errorf("include_tasks: %w", err)
+		}
+		if included, err = resolveIncludes(included, filepath.Dir(path), depth+1, vaults); err != nil {
+			return nil, err
+		}
+		delete(task, "include_tasks")
+		if task["name"] == nil {
+			task["name"] = "include " + include
+		}
+		task["block"] = included
+	}
+	return tasks, nil
+}
+
+// readTaskFile reads and validates a yaml file with a list of tasks
+func readTaskFile(path string, vaults VaultValues) (any, error) {
+	node, v, err := readYAML(path, vaults)
+	if err != nil {
+		return nil, err
+	}
+	return decodeTaskList(node, v)
+}
+
+// ParseTasks parses and validates a yaml list of tasks, such as the
+// examples of the runners
+func ParseTasks(name string, data []byte) ([]model.Task, error) {
+	node, v, err := parseYAML(name, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := decodeTaskList(node, v)
+	if err != nil {
+		return nil, err
+	}
+	tasks := []model.Task{}
+	if err := decode(raw, &tasks); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return tasks, nil
+}
+
+func decodeTaskList(node *yaml.Node, v *validator) (any, error) {
+	if node.Kind == 0 {
+		return []any{}, nil // empty file
+	}
+	v.tasks(node)
+	if err := v.result(); err != nil {
+		return nil, err
+	}
+	var tasks any
+	if err := node.Decode(&tasks); err != nil {
+		return nil, fmt.Errorf("%s: %w", v.file, err)
+	}
+	v.taskSources(node, tasks)
+	return tasks, nil
+}
+
+// loadRoles adds the tasks, handlers and default vars of the roles of play,
+// in the order they are listed, before those of the play itself
+func loadRoles(play *model.Play, dir string, vaults VaultValues) error {
+	if len(play.Roles) == 0 {
+		return nil
+	}
+	tasks := []model.Task{}
+	handlers := []model.Task{}
+	defaults := map[string]any{}
+
+	for _, name := range play.Roles {
+		if name == "" || strings.ContainsAny(name, `/\`) || name == ".." {
+			return fmt.Errorf("invalid role name %q", name)
+		}
+		roleDir := filepath.Join(dir, rolesDir, name)
+		if fi, err := os.Stat(roleDir); err != nil || !fi.IsDir() {
+			return fmt.Errorf("role %s not found in %s", name, roleDir)
+		}
+
+		roleTasks, err := loadRoleTasks(roleDir, "tasks", vaults)
+		if err != nil {
+			return fmt.Errorf("role %s: %w", name, err)
+		}
+		roleHandlers, err := loadRoleTasks(roleDir, "handlers", vaults)
+		if err != nil {
+			return fmt.Errorf("role %s: %w", name, err)
+		}
+		tasks = append(tasks, roleTasks...)
+		handlers = append(handlers, roleHandlers...)
+
+		vars, err := loadRoleDefaults(roleDir, vaults)
+		if err != nil {
+			return fmt.Errorf("role %s: %w", name, err)
+		}
+		maps.Copy(defaults, vars)
+	}
+
+	play.Tasks = slices.Concat(tasks, play.Tasks)
+	play.Handlers = slices.Concat(handlers, play.Handlers)
+
+	// play vars take precedence over role defaults
+	maps.Copy(defaults, play.Vars)
+	play.Vars = defaults
+	return nil
+}
+
+// loadRoleTasks loads <roleDir>/<kind>/main.yml, if it exists
+func loadRoleTasks(roleDir, kind string, vaults VaultValues) ([]model.Task, error) {
+	path := filepath.Join(roleDir, kind, "main.yml")
+	raw, err := readTaskFile(path, vaults)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if raw, err = resolveIncludes(raw, filepath.Dir(path), 0, vaults); err != nil {
+		return nil, err
+	}
+	tasks := []model.Task{}
+	if err := decode(raw, &tasks); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	setRoleFileArgs(tasks, roleDir)
+	return tasks, nil
+}
+
+// loadRoleDefaults loads <roleDir>/defaults/main.yml, if it exists
+func loadRoleDefaults(roleDir string, vaults VaultValues) (map[string]any, error) {
+	vars, err := ReadVarsFile(filepath.Join(roleDir, "defaults", "main.yml"), vaults)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return vars, err
+}
+
+// setRoleFileArgs makes the relative controller paths in tasks relative
+// to the role dir
+func setRoleFileArgs(tasks []model.Task, roleDir string) {
+	for i := range tasks {
+		t := &tasks[i]
+		for _, arg := range roleFileArgs[t.Runner] {
+			// other types are reported by CheckTask
+			if p, ok := t.Args[arg].(string); ok && p != "" && !filepath.IsAbs(p) {
+				t.Args[arg] = filepath.Join(roleDir, p)
+			}
+		}
+		setRoleFileArgs(t.Block, roleDir)
+		setRoleFileArgs(t.Rescue, roleDir)
+		setRoleFileArgs(t.Always, roleDir)
+	}
+}
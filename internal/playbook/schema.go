@@ -0,0 +1,229 @@
+package playbook
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+	"github.com/gwillem/whip/internal/runners"
+)
+
+// keyDescs are shown by editors when hovering over a play or task key
+var keyDescs = map[string]string{
+	"hosts":        "Targets, such as root@example.com",
+	"vars":         "Variables for templates and args, such as {{ user }}",
+	"vars_files":   "Yaml or json files with vars, relative to the playbook, may be encrypted",
+	"tasks":        "Tasks to run at the targets, in order",
+	"handlers":     "Tasks that run at the end of the play, if notified",
+	"prerun":       "Shell commands to run at the controller first, such as a build",
+	"roles":        "Roles from the roles dir next to the playbook",
+	"notify":       "Handlers (or listen topics) to run if the task changed something",
+	"listen":       "Topics that trigger this handler",
+	"loop":         "Runs the task for every item of a list, map or {{ var }}",
+	"tags":         "Tags to select tasks with",
+	"unless":       "Shell command at the target, the task is skipped if it succeeds",
+	"when":         "Condition, the task is skipped if it is false",
+	"loop_control": "Names of the loop vars, for nested loops",
+	"loop_var":     "Name of the item var, default item",
+	"index_var":    "Name of the zero based index var",
+	"block":        "Tasks that share tags, when and vars",
+	"rescue":       "Tasks that run if a task in the block fails",
+	"always":       "Tasks that run after the block, also if it failed",
+	includeKey:     "File with tasks, relative to the playbook",
+	"args":         "Runner args, merged with those after the runner key",
+	"name":         "Name to show in the output, or to notify a handler by",
+	"assetpath":    "Dir with assets, relative to the playbook",
+}
+
+// templated matches args that are rendered at the target, so their value
+// is not known yet
+var templated = map[string]any{"type": "string", "pattern": `\{\{`}
+
+// Schema returns a JSON Schema for playbooks, so editors with
+// yaml-language-server can complete and validate them. Tasks are checked
+// against the args of their runner.
+func Schema() map[string]any {
+	return map[string]any{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"title":   "whip playbook",
+		"type":    "array",
+		"items":   ref("play"),
+		"definitions": map[string]any{
+			"play":         structSchema(reflect.TypeOf(model.Play{})),
+			"task":         taskSchema(),
+			"tasks":        map[string]any{"type": "array", "items": ref("task")},
+			"loop_control": structSchema(reflect.TypeOf(model.LoopControl{})),
+		},
+	}
+}
+
+func ref(def string) map[string]any {
+	return map[string]any{"$ref": "#/definitions/" + def}
+}
+
+// taskSchema has the task keys and a key per runner, of which a task
+// should have exactly one, unless it is a block or an include
+func taskSchema() map[string]any {
+	s := structSchema(reflect.TypeOf(model.Task{}))
+	props := s["properties"].(map[string]any)
+	props[includeKey] = map[string]any{"type": "string", "description": keyDescs[includeKey]}
+
+	oneOf := []any{}
+	for _, name := range runners.All() {
+		meta, _ := runners.Meta(name)
+		props[name] = runnerSchema(meta)
+		oneOf = append(oneOf, map[string]any{"required": []string{name}})
+	}
+	for _, key := range []string{"block", includeKey} {
+		oneOf = append(oneOf, map[string]any{"required": []string{key}})
+	}
+	s["oneOf"] = oneOf
+	return s
+}
+
+// structSchema describes a struct by its yaml keys, see structKeys
+func structSchema(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	for i := range t.NumField() {
+		key := fieldKey(t.Field(i))
+		if key == "runner" || t.Field(i).Tag.Get("json") == "-" {
+			// set by the parser, from the runner key or the position
+			continue
+		}
+		s := typeSchema(t.Field(i).Type)
+		if desc := keyDescs[key]; desc != "" {
+			s["description"] = desc
+		}
+		props[key] = s
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": false,
+	}
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	switch {
+	case t == reflect.TypeOf(model.LoopControl{}):
+		return ref("loop_control")
+	case t == reflect.TypeOf([]model.Task{}):
+		return ref("tasks")
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice:
+		// a string is split on commas
+		return map[string]any{"anyOf": []any{
+			map[string]any{"type": "string"},
+			map[string]any{"type": "array", "items": typeSchema(t.Elem())},
+		}}
+	case reflect.Map:
+		return map[string]any{"type": "object"}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return map[string]any{}
+	}
+}
+
+// runnerSchema accepts a key=value string or a map with the runner args.
+// Runners that only take free-form args, such as shell, take a string.
+func runnerSchema(meta runners.RunnerMeta) map[string]any {
+	str := map[string]any{"type": "string"}
+	props := map[string]any{}
+	required := []string{}
+	for _, a := range meta.Args {
+		if a.Name == parser.DefaultArg {
+			str = argSchema(a)
+			continue
+		}
+		props[a.Name] = argSchema(a)
+		if a.Required {
+			required = append(required, a.Name)
+		}
+	}
+	if len(props) == 0 {
+		str["description"] = meta.Desc
+		return str
+	}
+
+	obj := map[string]any{
+		"type":                 "object",
+		"properties":           props,
+		"additionalProperties": meta.Extra != "",
+	}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+	if len(meta.PrefixAttrs) > 0 {
+		obj["patternProperties"] = map[string]any{"^/": prefixSchema(meta.PrefixAttrs)}
+		obj["additionalProperties"] = false
+	}
+	exclusive := []any{}
+	for _, group := range meta.Exclusive {
+		for i := range group {
+			for _, other := range group[i+1:] {
+				exclusive = append(exclusive, map[string]any{"not": map[string]any{"required": []string{group[i], other}}})
+			}
+		}
+	}
+	if len(exclusive) > 0 {
+		obj["allOf"] = exclusive
+	}
+
+	return map[string]any{
+		"description": meta.Desc,
+		"anyOf":       []any{str, obj},
+	}
+}
+
+// argSchema mirrors Arg.check, so templated values are always accepted
+func argSchema(a runners.Arg) map[string]any {
+	var s map[string]any
+	switch a.Kind {
+	case runners.ArgBool:
+		enum := []any{0, 1}
+		for _, b := range runners.BoolStrings {
+			enum = append(enum, b)
+		}
+		s = map[string]any{"anyOf": []any{map[string]any{"type": "boolean"}, map[string]any{"enum": enum}, templated}}
+	case runners.ArgInt:
+		s = map[string]any{"anyOf": []any{map[string]any{"type": "integer"}, map[string]any{"type": "string", "pattern": `^-?[0-9]+$`}, templated}}
+	case runners.ArgList:
+		s = map[string]any{"anyOf": []any{map[string]any{"type": "string"}, map[string]any{"type": "array", "items": map[string]any{"type": "string"}}}}
+	case runners.ArgMap:
+		s = map[string]any{"type": "object"}
+	default:
+		s = map[string]any{"type": "string"}
+		if len(a.Enum) > 0 {
+			s = map[string]any{"anyOf": []any{map[string]any{"enum": a.Enum}, templated}}
+		}
+	}
+
+	desc := []string{}
+	if a.Desc != "" {
+		desc = append(desc, strings.ToUpper(a.Desc[:1])+a.Desc[1:]+".")
+	}
+	if a.Default != "" {
+		desc = append(desc, "Default "+a.Default+".")
+	}
+	if len(desc) > 0 {
+		s["description"] = strings.Join(desc, " ")
+	}
+	return s
+}
+
+// prefixSchema matches the attributes of a path prefix, such as
+// "owner=www-data mode=0640" or, for a file, validate="visudo -cf %s"
+func prefixSchema(attrs []string) map[string]any {
+	return map[string]any{
+		"type":        "string",
+		"pattern":     fmt.Sprintf(`^\s*((%s)=("[^"]*"|'[^']*'|\S+)\s*)*$`, strings.Join(attrs, "|")),
+		"description": "Attributes for the files under this path: " + strings.Join(attrs, "=, ") + "=",
+	}
+}
@@ -0,0 +1,94 @@
+package playbook
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/vault"
+)
+
+// VaultValues are the values with a !vault tag in the yaml files of a
+// playbook, as the tag is lost when they are decoded. Only these are
+// decrypted, so a plain value that happens to look encrypted is left alone.
+type VaultValues map[string]bool
+
+func (vv VaultValues) add(s string) {
+	if vv != nil {
+		vv[strings.TrimSpace(s)] = true
+	}
+}
+
+func (vv VaultValues) has(s string) bool {
+	return vv[strings.TrimSpace(s)]
+}
+
+// Decrypt replaces the inline !vault values in the vars, args and loops of
+// a playbook with their plaintext. It runs on the controller, right before
+// the job is sent, so loading and linting a playbook doesn't need the key.
+// The vault values are those collected while loading the playbook.
+func Decrypt(pb *model.Playbook, vaults VaultValues) error {
+	d := &decrypter{plain: map[string]string{}, vaults: vaults}
+	for i := range *pb {
+		play := &(*pb)[i]
+		d.walkMap("play vars", play.Vars)
+		d.walkTasks(play.Tasks)
+		d.walkTasks(play.Handlers)
+	}
+	return d.err
+}
+
+// decrypter keeps the first error and the decrypted values, as looped tasks
+// have copies of the same vars
+type decrypter struct {
+	plain  map[string]string
+	vaults VaultValues
+	err    error
+}
+
+func (d *decrypter) walkTasks(tasks []model.Task) {
+	for i := range tasks {
+		t := &tasks[i]
+		label := taskLabel(*t)
+		d.walkMap(label+" args", t.Args)
+		d.walkMap(label+" vars", t.Vars)
+		t.Loop = d.walk(label, "loop", t.Loop)
+		d.walkTasks(t.Block)
+		d.walkTasks(t.Rescue)
+		d.walkTasks(t.Always)
+	}
+}
+
+func (d *decrypter) walkMap(where string, m map[string]any) {
+	for k, v := range m {
+		m[k] = d.walk(where, k, v)
+	}
+}
+
+func (d *decrypter) walk(where, key string, v any) any {
+	switch v := v.(type) {
+	case string:
+		if !d.vaults.has(v) {
+			return v
+		}
+		if plain, ok := d.plain[v]; ok {
+			return plain
+		}
+		plain, err := vault.DecryptString(v)
+		if err != nil {
+			if d.err == nil {
+				d.err = fmt.Errorf("cannot decrypt %s of %s: %w", key, where, err)
+			}
+			return v
+		}
+		d.plain[v] = plain
+		return plain
+	case map[string]any:
+		d.walkMap(where, v)
+	case []any:
+		for i := range v {
+			v[i] = d.walk(where, key, v[i])
+		}
+	}
+	return v
+}
@@ -0,0 +1,351 @@
+package playbook
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+	"github.com/gwillem/whip/internal/runners"
+	"github.com/gwillem/whip/internal/vault"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// includeKey is replaced by a block with the tasks of the included file
+	includeKey = "include_tasks"
+	// sourceKey holds the position of a raw task, see model.Task.Source
+	sourceKey = "_source"
+)
+
+var (
+	playKeys        = structKeys(reflect.TypeOf(model.Play{}))
+	taskKeys        = append(structKeys(reflect.TypeOf(model.Task{})), includeKey)
+	loopControlKeys = structKeys(reflect.TypeOf(model.LoopControl{}))
+	blockSections   = []string{"block", "rescue", "always"}
+)
+
+// Problem is a validation error at a position in a playbook or task file
+type Problem struct {
+	File    string
+	Line    int
+	Col     int
+	Msg     string
+	Snippet string
+}
+
+func (p *Problem) Error() string {
+	s := fmt.Sprintf("%s:%d:%d: %s", p.File, p.Line, p.Col, p.Msg)
+	if p.Snippet != "" {
+		s += "\n" + p.Snippet
+	}
+	return s
+}
+
+// validator checks the structure of a yaml file before it is decoded, so
+// problems can be reported with their position. Unknown keys next to a
+// runner are warnings, as they used to be.
+type validator struct {
+	file     string
+	lines    []string
+	problems []error
+	warnings []*Problem
+	vaults   VaultValues // of the playbook that is loaded
+}
+
+// readYAML reads and parses a yaml file, keeping the source positions
+func readYAML(path string, vaults VaultValues) (*yaml.Node, *validator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseYAML(path, data, vaults)
+}
+
+// parseYAML parses yaml data from file, keeping the source positions. The
+// !vault values are added to vaults.
+func parseYAML(file string, data []byte, vaults VaultValues) (*yaml.Node, *validator, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", file, err)
+	}
+	v := &validator{file: file, lines: strings.Split(string(data), "\n"), vaults: vaults}
+	v.vaultTags(&doc)
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		return doc.Content[0], v, nil
+	}
+	return &doc, v, nil
+}
+
+// result logs the warnings and returns the problems, if any
+func (v *validator) result() error {
+	for _, w := range v.warnings {
+		log.Warn(w.Error())
+	}
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return errors.Join(v.problems...)
+}
+
+func (v *validator) problem(n *yaml.Node, format string, args ...any) *Problem {
+	return &Problem{
+		File:    v.file,
+		Line:    n.Line,
+		Col:     n.Column,
+		Msg:     fmt.Sprintf(format, args...),
+		Snippet: snippet(v.lines, n.Line, n.Column),
+	}
+}
+
+// snippet shows a line of the source, with a marker at col
+func snippet(lines []string, line, col int) string {
+	if line <= 0 || line > len(lines) {
+		return ""
+	}
+	prefix := fmt.Sprintf("%5d | ", line)
+	return prefix + lines[line-1] + "\n" +
+		strings.Repeat(" ", len(prefix)-2) + "| " + strings.Repeat(" ", max(col-1, 0)) + "^"
+}
+
+// taskProblem is a problem with a task that was found after parsing, at
+// the position of the task if it is known
+func taskProblem(t model.Task, msg string) error {
+	src := t.Source
+	if src == nil {
+		return errors.New(msg)
+	}
+	p := &Problem{File: src.File, Line: src.Line, Col: src.Col, Msg: msg}
+	if data, err := os.ReadFile(src.File); err == nil {
+		p.Snippet = snippet(strings.Split(string(data), "\n"), src.Line, src.Col)
+	}
+	return p
+}
+
+func (v *validator) errorf(n *yaml.Node, format string, args ...any) {
+	v.problems = append(v.problems, v.problem(n, format, args...))
+}
+
+func (v *validator) warnf(n *yaml.Node, format string, args ...any) {
+	v.warnings = append(v.warnings, v.problem(n, format, args...))
+}
+
+// vaultTags checks that inline !vault values are encrypted and keeps them,
+// they are decrypted when the playbook is run, see Decrypt
+func (v *validator) vaultTags(n *yaml.Node) {
+	if n.Tag == vault.InlineTag {
+		switch {
+		case n.Kind != yaml.ScalarNode:
+			v.errorf(n, "%s should be an encrypted string", vault.InlineTag)
+		case !vault.IsEncryptedString(n.Value):
+			v.errorf(n, "%s value is not encrypted, use \"whip vault encrypt-string\"", vault.InlineTag)
+		default:
+			v.vaults.add(n.Value)
+		}
+	}
+	for _, c := range n.Content {
+		v.vaultTags(c)
+	}
+}
+
+func (v *validator) playbook(n *yaml.Node) {
+	if n.Kind != yaml.SequenceNode {
+		v.errorf(n, "playbook should be a list of plays")
+		return
+	}
+	for _, play := range n.Content {
+		v.play(play)
+	}
+}
+
+func (v *validator) play(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		v.errorf(n, "play should be a map")
+		return
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		key, val := n.Content[i], n.Content[i+1]
+		switch {
+		case key.Value == "tasks" || key.Value == "handlers":
+			v.tasks(val)
+		case !slices.Contains(playKeys, key.Value):
+			v.warnf(key, "unknown play key %q%s", key.Value, parser.Suggest(key.Value, playKeys))
+		}
+	}
+}
+
+func (v *validator) tasks(n *yaml.Node) {
+	switch n.Kind {
+	case yaml.SequenceNode:
+		for _, task := range n.Content {
+			v.task(task)
+		}
+	case yaml.ScalarNode:
+		if n.Tag == "!!null" {
+			return
+		}
+		fallthrough
+	default:
+		v.errorf(n, "tasks should be a list")
+	}
+}
+
+func (v *validator) task(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		v.errorf(n, "task should be a map, such as \"- shell: echo hello\"")
+		return
+	}
+
+	allRunners := runners.All()
+	var runnerKey *yaml.Node
+	hasBlock := false
+	unknown := []*yaml.Node{}
+
+	for i := 0; i < len(n.Content); i += 2 {
+		key, val := n.Content[i], n.Content[i+1]
+		switch {
+		case slices.Contains(allRunners, key.Value):
+			if runnerKey != nil {
+				v.errorf(key, "single task cannot have multiple runners (%s and %s)", runnerKey.Value, key.Value)
+				continue
+			}
+			runnerKey = key
+			if !(val.Kind == yaml.MappingNode || val.Kind == yaml.ScalarNode && val.Tag == "!!str") {
+				v.errorf(val, "unexpected type for %s args, should be a string or a map", key.Value)
+			}
+			v.runnerArgs(key, val)
+		case slices.Contains(blockSections, key.Value):
+			hasBlock = hasBlock || key.Value == "block"
+			v.tasks(val)
+		case key.Value == includeKey:
+			hasBlock = true
+			if val.Kind != yaml.ScalarNode {
+				v.errorf(val, "%s should be a file name", includeKey)
+			}
+		case key.Value == "loop_control":
+			v.loopControl(val)
+		case !slices.Contains(taskKeys, key.Value):
+			unknown = append(unknown, key)
+		}
+	}
+
+	candidates := slices.Concat(allRunners, taskKeys)
+	switch {
+	case runnerKey != nil && hasBlock:
+		v.errorf(runnerKey, "task cannot have both a runner (%s) and a block or include", runnerKey.Value)
+	case runnerKey == nil && !hasBlock && len(unknown) > 0:
+		for _, key := range unknown {
+			v.errorf(key, "unknown runner or task key %q%s", key.Value, parser.Suggest(key.Value, candidates))
+		}
+		return
+	case runnerKey == nil && !hasBlock:
+		v.errorf(n, "task has no runner, such as \"shell: echo hello\"")
+	}
+	for _, key := range unknown {
+		v.warnf(key, "unknown task key %q%s", key.Value, parser.Suggest(key.Value, candidates))
+	}
+}
+
+// runnerArgs reports task keys in the args of a runner, such as unless,
+// which would otherwise be taken as unknown args
+func (v *validator) runnerArgs(runner, n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+	meta, _ := runners.Meta(runner.Value)
+	for i := 0; i < len(n.Content); i += 2 {
+		key := n.Content[i]
+		isArg := slices.ContainsFunc(meta.Args, func(a runners.Arg) bool { return a.Name == key.Value })
+		if !isArg && slices.Contains(taskKeys, key.Value) {
+			v.errorf(key, "%s is a task key, it should be next to %s, not in its args", key.Value, runner.Value)
+		}
+	}
+}
+
+// playSources adds the position of every task of the plays in raw, which
+// was decoded from n
+func (v *validator) playSources(n *yaml.Node, raw any) {
+	plays, ok := raw.([]any)
+	if !ok || n.Kind != yaml.SequenceNode || len(n.Content) != len(plays) {
+		return
+	}
+	for i, p := range plays {
+		play, ok := p.(map[string]any)
+		pn := n.Content[i]
+		if !ok || pn.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j < len(pn.Content); j += 2 {
+			if key := pn.Content[j].Value; key == "tasks" || key == "handlers" {
+				v.taskSources(pn.Content[j+1], play[key])
+			}
+		}
+	}
+}
+
+// taskSources adds the position of every task in raw, which was decoded
+// from n, as sourceKey
+func (v *validator) taskSources(n *yaml.Node, raw any) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	tasks, ok := raw.([]any)
+	if !ok || n.Kind != yaml.SequenceNode || len(n.Content) != len(tasks) {
+		return
+	}
+	for i, t := range tasks {
+		task, ok := t.(map[string]any)
+		tn := n.Content[i]
+		if tn.Kind == yaml.AliasNode {
+			tn = tn.Alias
+		}
+		if !ok || tn.Kind != yaml.MappingNode {
+			continue
+		}
+		task[sourceKey] = &model.Source{File: v.file, Line: tn.Line, Col: tn.Column}
+		for j := 0; j < len(tn.Content); j += 2 {
+			if key := tn.Content[j].Value; slices.Contains(blockSections, key) {
+				v.taskSources(tn.Content[j+1], task[key])
+			}
+		}
+	}
+}
+
+func (v *validator) loopControl(n *yaml.Node) {
+	if n.Kind != yaml.MappingNode {
+		v.errorf(n, "loop_control should be a map")
+		return
+	}
+	for i := 0; i < len(n.Content); i += 2 {
+		if key := n.Content[i]; !slices.Contains(loopControlKeys, key.Value) {
+			v.errorf(key, "unknown loop_control key %q%s", key.Value, parser.Suggest(key.Value, loopControlKeys))
+		}
+	}
+}
+
+// structKeys returns the yaml keys of a struct: the mapstructure tag or
+// the lowercase field name
+func structKeys(t reflect.Type) []string {
+	keys := []string{}
+	for i := range t.NumField() {
+		if t.Field(i).Tag.Get("json") == "-" {
+			continue // set by the parser
+		}
+		keys = append(keys, fieldKey(t.Field(i)))
+	}
+	return keys
+}
+
+// fieldKey returns the yaml key of a struct field, as decoded by mapstructure
+func fieldKey(f reflect.StructField) string {
+	key, _, _ := strings.Cut(f.Tag.Get("mapstructure"), ",")
+	if key == "" {
+		key = strings.ToLower(f.Name)
+	}
+	return key
+}
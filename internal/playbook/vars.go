@@ -0,0 +1,134 @@
+package playbook
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+	"github.com/gwillem/whip/internal/vault"
+	"gopkg.in/yaml.v3"
+)
+
+// Vars are merged in this order, later ones take precedence:
+//
+//  1. role defaults
+//  2. play vars
+//  3. play vars_files, in the order they are listed
+//  4. block and task vars, the innermost block wins
+//  5. extra vars, given with -e on the command line
+//
+// Loop vars (item, loop and those set with loop_control) are set for every
+// iteration, so they cannot be overridden. Inventory vars are not supported
+// yet, as hosts are listed in the play.
+
+// loadVarsFiles merges the vars files of a play into its vars. Files can
+// be encrypted with "whip edit".
+func loadVarsFiles(play *model.Play, dir string, vaults VaultValues) error {
+	if len(play.VarsFiles) == 0 {
+		return nil
+	}
+	vars := maps.Clone(play.Vars)
+	if vars == nil {
+		vars = map[string]any{}
+	}
+	for _, name := range play.VarsFiles {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, name)
+		}
+		fileVars, err := ReadVarsFile(path, vaults)
+		if err != nil {
+			return fmt.Errorf("vars_files: %w", err)
+		}
+		maps.Copy(vars, fileVars)
+	}
+	play.Vars = vars
+	return nil
+}
+
+// ReadVarsFile reads a yaml or json map of vars, which is decrypted if it
+// is encrypted. Inline !vault values are added to vaults, they are decrypted
+// when the playbook is run.
+func ReadVarsFile(path string, vaults VaultValues) (map[string]any, error) {
+	data, err := vault.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	node, v, err := parseYAML(path, data, vaults)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.result(); err != nil {
+		return nil, err
+	}
+	vars := map[string]any{}
+	if node.Kind == 0 {
+		return vars, nil // empty file
+	}
+	if err := node.Decode(&vars); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// ParseExtraVars parses the -e args, which are key=value pairs, @file with
+// yaml or json vars, or an inline json map. Later args take precedence.
+// The !vault values in vars files are added to vaults.
+func ParseExtraVars(args []string, vaults VaultValues) (map[string]any, error) {
+	extra := map[string]any{}
+	for _, arg := range args {
+		var vars map[string]any
+		switch {
+		case strings.HasPrefix(arg, "@"):
+			v, err := ReadVarsFile(arg[1:], vaults)
+			if err != nil {
+				return nil, err
+			}
+			vars = v
+		case strings.HasPrefix(strings.TrimSpace(arg), "{"):
+			if err := yaml.Unmarshal([]byte(arg), &vars); err != nil {
+				return nil, fmt.Errorf("extra vars %s: %w", arg, err)
+			}
+		default:
+			kv := parser.ParseArgString(arg)
+			if s := kv.String(parser.DefaultArg); s != "" {
+				return nil, fmt.Errorf("extra var %q should be key=value or @file", s)
+			}
+			delete(kv, parser.DefaultArg)
+			vars = kv
+		}
+		maps.Copy(extra, vars)
+	}
+	return extra, nil
+}
+
+// applyExtraVars sets the extra vars on the play and overrides them in the
+// tasks and handlers that set them too
+func applyExtraVars(play *model.Play, extra map[string]any) {
+	if len(extra) == 0 {
+		return
+	}
+	if play.Vars == nil {
+		play.Vars = map[string]any{}
+	}
+	maps.Copy(play.Vars, extra)
+	overrideTaskVars(play.Tasks, extra)
+	overrideTaskVars(play.Handlers, extra)
+}
+
+func overrideTaskVars(tasks []model.Task, extra map[string]any) {
+	for i := range tasks {
+		t := &tasks[i]
+		for k, v := range extra {
+			if _, ok := t.Vars[k]; ok {
+				t.Vars[k] = v
+			}
+		}
+		overrideTaskVars(t.Block, extra)
+		overrideTaskVars(t.Rescue, extra)
+		overrideTaskVars(t.Always, extra)
+	}
+}
@@ -0,0 +1,90 @@
+package runners
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+)
+
+const apkBin = "/sbin/apk"
+
+// apk prints packages as name-version, where version ends with -r<n>
+var apkNameVersion = regexp.MustCompile(`^(.+)-([0-9][^-]*-r[0-9]+)$`)
+
+// apkManager is the pkgManager for Alpine
+type apkManager struct{}
+
+func newApkManager(model.TaskArgs) (pkgManager, error) {
+	if !isExecutable(apkBin) {
+		return nil, fmt.Errorf("cannot run %s", apkBin)
+	}
+	return apkManager{}, nil
+}
+
+func (m apkManager) current() (map[string]pkgInstalled, error) {
+	data, err := queryPkgManager([]int{0}, apkBin, "info", "-v")
+	if err != nil {
+		return nil, err
+	}
+	return parseApkPackages(data), nil
+}
+
+// parseApkPackages parses the first field of lines like "busybox-1.36.1-r5"
+// or "busybox-1.36.1-r5 < 1.36.1-r6"
+func parseApkPackages(data string) map[string]pkgInstalled {
+	pkgs := map[string]pkgInstalled{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if m := apkNameVersion.FindStringSubmatch(fields[0]); m != nil {
+			pkgs[m[1]] = pkgInstalled{version: m[2]}
+		}
+	}
+	return pkgs
+}
+
+func (m apkManager) upgradable(names []string, _ map[string]pkgInstalled) (map[string]bool, error) {
+	data, err := queryPkgManager([]int{0}, append([]string{apkBin, "version", "-l", "<"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	upgradable := map[string]bool{}
+	for name := range parseApkPackages(data) {
+		upgradable[name] = true
+	}
+	return upgradable, nil
+}
+
+func (m apkManager) apply(w pkgWork) model.TaskResult {
+	if len(w.hold)+len(w.unhold) > 0 {
+		return failure("hold is not supported for apk, use a version instead")
+	}
+	install := []string{}
+	for _, p := range w.install {
+		install = append(install, apkVersion(p))
+	}
+	return runSteps([]pkgStep{
+		{apkBin + " add -q", install, runShell},
+		{apkBin + " add -q -u", w.upgrade, runShell},
+		{apkBin + " del -q", w.remove, runShell},
+		{apkBin + " del -q --purge", w.purge, runShell},
+	})
+}
+
+// apkVersion translates a version glob such as 1.24.* to the fuzzy
+// apk constraint name~1.24
+func apkVersion(p pkgVersion) string {
+	switch {
+	case p.version == "":
+		return p.name
+	case strings.Contains(p.version, "*"):
+		prefix, _, _ := strings.Cut(p.version, "*")
+		return p.name + "~" + strings.TrimSuffix(prefix, ".")
+	default:
+		return p.name + "=" + p.version
+	}
+}
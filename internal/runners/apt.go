@@ -12,130 +12,305 @@ https://manpages.ubuntu.com/manpages/xenial/man8/apt.8.html
 package runners
 
 import (
+	"fmt"
 	"os/exec"
+	"path"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	log "github.com/gwillem/go-simplelog"
 	"github.com/gwillem/whip/internal/model"
-	"github.com/gwillem/whip/internal/parser"
-	"golang.org/x/exp/maps"
 )
 
 const (
-	aptBin    = "/usr/bin/apt-get"
-	installed = "install"
-	removed   = "remove"
-	purged    = "purge"
-	dpkgOpt   = `-o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold"`
+	aptBin         = "/usr/bin/apt-get"
+	aptEnv         = "DEBIAN_FRONTEND=noninteractive"
+	aptUpdateStamp = "/var/lib/apt/periodic/update-success-stamp"
+	aptListsDir    = "/var/lib/apt/lists"
+	dpkgOpt        = `-o Dpkg::Options::="--force-confdef" -o Dpkg::Options::="--force-confold"`
 )
 
-var aptStateMap = map[string]string{
-	"present": installed,
-	"absent":  removed,
-	"purged":  purged,
+var aptSummary = regexp.MustCompile(`(\d+) upgraded, (\d+) newly installed, (\d+) to remove`)
+
+// aptUpgradeMap maps the upgrade arg to an apt-get command
+var aptUpgradeMap = map[string]string{
+	"":     "",
+	"no":   "",
+	"yes":  "upgrade --with-new-pkgs",
+	"safe": "upgrade --with-new-pkgs",
+	"dist": "dist-upgrade",
+	"full": "dist-upgrade",
 }
 
-type aptPkgState map[string]map[string]bool
+// aptManager is the pkgManager for Debian and Ubuntu
+type aptManager struct {
+	lockTimeout time.Duration
+}
 
-func (aps aptPkgState) add(pkg, state string) {
-	if aps[state] == nil {
-		aps[state] = map[string]bool{}
+func newAptManager(args model.TaskArgs) (pkgManager, error) {
+	if !isExecutable(aptBin) {
+		return nil, fmt.Errorf("cannot run %s", aptBin)
 	}
-	aps[state][pkg] = true
+	lockTimeout, err := aptLockTimeout(args)
+	if err != nil {
+		return nil, err
+	}
+	return aptManager{lockTimeout: lockTimeout}, nil
 }
 
-func (aps aptPkgState) has(pkg, state string) bool {
-	return aps[state][pkg]
+func (m aptManager) current() (map[string]pkgInstalled, error) {
+	data, err := exec.Command("dpkg-query", "-W", "-f", `${Package}\t${Version}\t${db:Status-Abbrev}\n`).CombinedOutput()
+	if err != nil {
+		return nil, err
+	}
+	return parseDpkgQuery(string(data)), nil
 }
 
-func buildCurrent() (aptPkgState, error) {
-	pkglist := aptPkgState{}
+// parseDpkgQuery parses lines of "name version status", where status is
+// like "ii " (wanted install, is installed), "hi " (wanted hold, is installed)
+// or "rc " (removed, config files are left)
+func parseDpkgQuery(data string) map[string]pkgInstalled {
+	pkgs := map[string]pkgInstalled{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 || len(fields[2]) < 2 {
+			continue
+		}
+		switch fields[2][1] {
+		case 'i':
+			pkgs[fields[0]] = pkgInstalled{version: fields[1], held: fields[2][0] == 'h'}
+		case 'c':
+			pkgs[fields[0]] = pkgInstalled{version: fields[1], configOnly: true}
+		}
+	}
+	return pkgs
+}
 
-	data, err := exec.Command("apt", "list", "--installed").CombinedOutput()
+// upgradable compares the installed version with the apt candidate
+func (m aptManager) upgradable(names []string, current map[string]pkgInstalled) (map[string]bool, error) {
+	data, err := exec.Command("apt-cache", append([]string{"policy"}, names...)...).CombinedOutput()
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("apt-cache policy: %w\n%s", err, data)
+	}
+	upgradable := map[string]bool{}
+	for name, candidate := range parseAptPolicy(string(data)) {
+		upgradable[name] = candidate != "(none)" && candidate != current[name].version
 	}
+	return upgradable, nil
+}
 
-	for _, line := range strings.Split(string(data), "\n") {
-		if len(line) == 0 {
+func parseAptPolicy(data string) map[string]string {
+	candidates := map[string]string{}
+	pkg := ""
+	for _, line := range strings.Split(data, "\n") {
+		if !strings.HasPrefix(line, " ") && strings.HasSuffix(line, ":") {
+			pkg = strings.TrimSuffix(line, ":")
 			continue
 		}
-		pkg := strings.Split(line, "/")[0]
-		pkglist.add(pkg, installed)
+		if v, ok := strings.CutPrefix(strings.TrimSpace(line), "Candidate: "); ok && pkg != "" {
+			candidates[pkg] = v
+		}
 	}
-	return pkglist, nil
+	return candidates
 }
 
-func getState(s string) string {
-	if val := aptStateMap[s]; val != "" {
-		return val
+// aptVersion resolves a version glob such as 1.24.* to the newest available
+// version that matches, as apt-get only takes exact versions
+func aptVersion(name, version string) (string, error) {
+	if !strings.ContainsAny(version, "*?[") {
+		return version, nil
+	}
+	data, err := queryPkgManager(nil, "apt-cache", "madison", name)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := matchAptMadison(data, version); ok {
+		return v, nil
 	}
-	return installed
+	return "", fmt.Errorf("no version of %s matches %s", name, version)
 }
 
-func buildWanted(args model.TaskArgs) (aptPkgState, error) {
-	pkglist := aptPkgState{}
-	defaultState := getState(args.String("state"))
-	for _, p := range args.StringSlice("name") {
-		state := defaultState
-		args := parser.ParseArgString(p)
-		if s := args.String("state"); s != "" {
-			state = getState(s)
+// matchAptMadison returns the first version in the output of apt-cache
+// madison that matches glob. Madison lists the newest versions first.
+func matchAptMadison(data, glob string) (string, bool) {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) < 3 || strings.HasSuffix(strings.TrimSpace(fields[2]), "Sources") {
+			continue
+		}
+		v := strings.TrimSpace(fields[1])
+		if ok, _ := path.Match(glob, v); ok {
+			return v, true
 		}
-		pkglist.add(args.String(parser.DefaultArg), state)
 	}
-	return pkglist, nil
+	return "", false
 }
 
 func apt(t *model.Task) (tr model.TaskResult) {
-	if !isExecutable(aptBin) {
-		return failure("cannot run", aptBin)
+	upgrade, ok := aptUpgradeMap[strings.ToLower(t.Args.String("upgrade"))]
+	if !ok {
+		return failure("unknown upgrade, try yes|safe|dist|full|no")
 	}
 
-	current, err := buildCurrent()
+	pm, err := newAptManager(t.Args)
 	if err != nil {
-		return failure("cannot get current apt state", err)
+		return failure(err)
 	}
-	wanted, err := buildWanted(t.Args)
-	if err != nil {
-		return failure("cannot get wanted apt state", err)
+	lockTimeout := pm.(aptManager).lockTimeout
+
+	tr.Status = Success
+
+	// merge the result of a step into the task result
+	add := func(res model.TaskResult) bool {
+		tr.Changed = tr.Changed || res.Changed
+		tr.Output += res.Output
+		if res.Status == Failed {
+			tr.Status = Failed
+			return false
+		}
+		return true
 	}
 
-	worklist := aptPkgState{}
-	for state, pkgs := range wanted {
-		for p := range pkgs {
-			if state == installed && !current.has(p, state) {
-				worklist.add(p, state)
-			} else if state != installed && current.has(p, installed) {
-				worklist.add(p, state)
+	if t.Args.Bool("update_cache") {
+		validTime, err := t.Args.Int("cache_valid_time")
+		if err != nil {
+			return failure(err)
+		}
+		if age := aptCacheAge(); age >= time.Duration(validTime)*time.Second {
+			log.Debug("apt cache age", age, "updating")
+			res := runAptGet("update", lockTimeout)
+			if !add(res) {
+				return tr
 			}
 		}
 	}
 
-	total := 0
+	if !add(ensurePackages(pm, t.Args)) {
+		return tr
+	}
 
-	for state, pkgs := range worklist {
-		if len(pkgs) == 0 {
-			log.Debug("nothing in state (should not happen!)", state)
-			continue
+	if upgrade != "" {
+		add(runAptGet(upgrade, lockTimeout))
+	}
+	return tr
+}
+
+// apply installs, removes and (un)holds packages. Removals are done in
+// the same transaction as installs, by appending a minus to the name.
+func (m aptManager) apply(w pkgWork) model.TaskResult {
+	install := slices.Clone(w.upgrade)
+	for _, p := range w.install {
+		if p.version != "" {
+			version, err := aptVersion(p.name, p.version)
+			if err != nil {
+				return failure(err)
+			}
+			install = append(install, p.name+"="+version)
+		} else {
+			install = append(install, p.name)
 		}
-		total += len(pkgs)
-		args := append([]string{state}, maps.Keys(pkgs)...)
-		log.Debug("running apt-mark with", args)
-		data, err := exec.Command("apt-mark", args...).CombinedOutput()
-		if err != nil {
-			return failure("cannot mark packages\n" + string(data))
+	}
+	for _, p := range w.remove {
+		install = append(install, p+"-")
+	}
+
+	aptGet := func(cmd string) model.TaskResult { return runAptGet(cmd, m.lockTimeout) }
+	aptMark := func(cmd string) model.TaskResult {
+		if res := aptPrepare(m.lockTimeout); res.Status == Failed {
+			return res
 		}
-		log.Debug("apt-mark", string(data))
+		return runShell("apt-mark " + cmd)
 	}
 
-	if total == 0 {
-		return model.TaskResult{Status: Success}
+	return runSteps([]pkgStep{
+		{"unhold", w.unhold, aptMark},
+		{"install --allow-change-held-packages", install, aptGet},
+		{"purge", w.purge, aptGet},
+		{"hold", w.hold, aptMark},
+	})
+}
+
+// runAptGet runs an apt-get command, and reports changed only if
+// apt actually installed, upgraded or removed any packages. It waits
+// for the dpkg lock and retries once on lock or interrupted dpkg errors.
+func runAptGet(cmd string, lockTimeout time.Duration) (tr model.TaskResult) {
+	for attempt := 1; attempt <= 2; attempt++ {
+		prep := aptPrepare(lockTimeout)
+		tr.Output += prep.Output
+		tr.Changed = tr.Changed || prep.Changed
+		if prep.Status == Failed {
+			tr.Status = Failed
+			return tr
+		}
+
+		res := runShell(fmt.Sprintf("%s apt-get %s -y -q -o DPkg::Lock::Timeout=%d %s",
+			aptEnv, cmd, int(lockTimeout.Seconds()), dpkgOpt))
+		tr.Output += res.Output
+		tr.Status = res.Status
+		tr.Changed = tr.Changed || aptChanged(res.Output)
+		if res.Status != Failed || !aptRetryable(res.Output) {
+			break
+		}
+		log.Warn("apt-get", cmd, "failed, attempt", attempt, "of 2")
 	}
+	return tr
+}
 
-	return runShell("DEBIAN_FRONTEND=noninteractive apt-get dselect-upgrade -y -q " + dpkgOpt)
+// aptChanged parses the summary line of apt-get, such as
+// "2 upgraded, 1 newly installed, 0 to remove and 3 not upgraded."
+func aptChanged(output string) bool {
+	for _, m := range aptSummary.FindAllStringSubmatch(output, -1) {
+		for _, n := range m[1:] {
+			if n != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aptCacheAge returns the time since the last apt-get update, based on the
+// update-success stamp or the newest package list
+func aptCacheAge() time.Duration {
+	var newest time.Time
+	if fi, err := fs.Stat(aptUpdateStamp); err == nil {
+		newest = fi.ModTime()
+	}
+	if entries, err := fsutil.ReadDir(aptListsDir); err == nil {
+		for _, fi := range entries {
+			if fi.ModTime().After(newest) {
+				newest = fi.ModTime()
+			}
+		}
+	}
+	return time.Since(newest)
 }
 
 func init() {
-	registerRunner("apt", runner{run: apt})
+	registerRunner("apt", runner{
+		run: apt,
+		meta: RunnerMeta{
+			Desc: "Installs, upgrades, removes and holds packages with apt-get, in a single transaction",
+			Args: []Arg{
+				pkgNameArg,
+				stateArg,
+				holdArg,
+				{Name: "update_cache", Kind: ArgBool, Default: "no", Desc: "run apt-get update first"},
+				{Name: "cache_valid_time", Kind: ArgInt, Default: "0", Desc: "skip the update if the cache is younger, in seconds"},
+				{Name: "upgrade", Kind: ArgString, Enum: []string{"yes", "safe", "dist", "full", "no"}, Default: "no", Desc: "upgrade all packages"},
+				lockTimeoutArg,
+			},
+			Examples: []string{`
+- apt:
+    update_cache: yes
+    cache_valid_time: 3600
+    name:
+      - nginx
+      - php8.3-fpm=8.3.6* hold=yes
+      - apache2 state=purged
+`},
+		},
+	})
 }
@@ -0,0 +1,133 @@
+package runners
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+)
+
+// apt and dpkg can be locked by unattended-upgrades (notably on fresh VMs),
+// or be left in an interrupted state. So we wait for the lock, recover
+// with "dpkg --configure -a" and retry a failed transaction once.
+
+const (
+	dpkgLockFrontend   = "/var/lib/dpkg/lock-frontend"
+	dpkgUpdatesDir     = "/var/lib/dpkg/updates"
+	defaultLockTimeout = 5 * time.Minute
+	lockPollInterval   = time.Second
+	lockReportInterval = 10 * time.Second
+)
+
+var aptRetryableErrors = []string{
+	"Could not get lock",
+	"Unable to acquire the dpkg frontend lock",
+	"dpkg was interrupted",
+}
+
+// dpkgLockHolder returns the pid that holds the (fcntl) lock on path, or 0.
+// A var, so it can be stubbed in tests.
+var dpkgLockHolder = func(path string) (int, error) {
+	fh, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer fh.Close()
+
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK}
+	if err := syscall.FcntlFlock(fh.Fd(), syscall.F_GETLK, &lk); err != nil {
+		return 0, err
+	}
+	if lk.Type == syscall.F_UNLCK {
+		return 0, nil
+	}
+	return int(lk.Pid), nil
+}
+
+func aptLockTimeout(args model.TaskArgs) (time.Duration, error) {
+	if args["lock_timeout"] == nil {
+		return defaultLockTimeout, nil
+	}
+	secs, err := args.Int("lock_timeout")
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// waitForDpkgLock blocks until the dpkg frontend lock is free, or the timeout
+// has passed. It returns a note for the task output if it had to wait.
+func waitForDpkgLock(timeout time.Duration) (string, error) {
+	start := time.Now()
+	lastReport := start
+	for {
+		pid, err := dpkgLockHolder(dpkgLockFrontend)
+		if err != nil {
+			return "", fmt.Errorf("cannot check dpkg lock: %w", err)
+		}
+		waited := time.Since(start).Round(time.Second)
+		if pid == 0 {
+			if waited == 0 {
+				return "", nil
+			}
+			return fmt.Sprintf("waited %s for dpkg lock\n", waited), nil
+		}
+		if waited >= timeout {
+			return "", fmt.Errorf("dpkg lock still held by %s after %s", processName(pid), waited)
+		}
+		if time.Since(lastReport) >= lockReportInterval {
+			log.Progress("Waiting for dpkg lock held by", processName(pid), waited)
+			lastReport = time.Now()
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+func processName(pid int) string {
+	comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid))
+	if err != nil {
+		return fmt.Sprintf("pid %d", pid)
+	}
+	return fmt.Sprintf("pid %d (%s)", pid, strings.TrimSpace(string(comm)))
+}
+
+// dpkgInterrupted reports whether a previous dpkg run was interrupted,
+// which leaves journal files in the updates dir
+func dpkgInterrupted() bool {
+	entries, err := fsutil.ReadDir(dpkgUpdatesDir)
+	return err == nil && len(entries) > 0
+}
+
+// aptPrepare waits for the dpkg lock and recovers an interrupted dpkg
+func aptPrepare(timeout time.Duration) (tr model.TaskResult) {
+	note, err := waitForDpkgLock(timeout)
+	if err != nil {
+		return failure(err)
+	}
+	tr.Output = note
+	tr.Status = Success
+
+	if dpkgInterrupted() {
+		log.Warn("dpkg was interrupted, running dpkg --configure -a")
+		res := runShell(aptEnv + " dpkg --configure -a --force-confdef --force-confold")
+		tr.Output += "dpkg was interrupted, ran dpkg --configure -a\n" + res.Output
+		tr.Changed = res.Changed
+		tr.Status = res.Status
+	}
+	return tr
+}
+
+func aptRetryable(output string) bool {
+	for _, e := range aptRetryableErrors {
+		if strings.Contains(output, e) {
+			return true
+		}
+	}
+	return false
+}
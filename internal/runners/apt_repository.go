@@ -0,0 +1,323 @@
+package runners
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/vault"
+)
+
+/*
+
+apt_repository writes a deb822 sources file with a dedicated keyring, see
+https://wiki.debian.org/DebianRepository/UseThirdParty
+
+	- apt_repository:
+	    name: nginx
+	    uris: https://nginx.org/packages/mainline/debian
+	    components: nginx
+	    key: https://nginx.org/keys/nginx_signing.key
+
+The key is either a URL (fetched by the target) or a local file (which may
+be vaulted). ASCII armored keys are converted to binary, as apt expects.
+
+*/
+
+const (
+	aptSourcesDir   = "/etc/apt/sources.list.d"
+	aptKeyringsDir  = "/etc/apt/keyrings"
+	keyFetchTimeout = 30 * time.Second
+)
+
+var aptRepoName = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+func init() {
+	registerRunner("apt_repository", runner{
+		run:    aptRepository,
+		prerun: aptRepositoryPrerun,
+		meta: RunnerMeta{
+			Desc: "Adds an apt repository as a deb822 sources file, with a dedicated signing key",
+			Args: []Arg{
+				{Name: "name", Kind: ArgString, Required: true, Desc: "name of the sources and keyring files"},
+				{Name: "uris", Kind: ArgList, Desc: "repository URLs"},
+				{Name: "suites", Kind: ArgList, Default: "os codename", Desc: "such as bookworm"},
+				{Name: "components", Kind: ArgList, Default: "main"},
+				{Name: "types", Kind: ArgList, Default: "deb", Desc: "deb and/or deb-src"},
+				{Name: "architectures", Kind: ArgList},
+				{Name: "key", Kind: ArgString, Desc: "URL or local (vaulted) file with the signing key, armored or binary"},
+				{Name: "state", Kind: ArgString, Enum: []string{"present", "absent"}, Default: "present"},
+				lockTimeoutArg,
+			},
+			Examples: []string{`
+- apt_repository:
+    name: nginx
+    uris: https://nginx.org/packages/mainline/debian
+    components: nginx
+    key: https://nginx.org/keys/nginx_signing.key
+`},
+		},
+	})
+}
+
+func isURL(s string) bool {
+	return strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://")
+}
+
+// aptRepositoryPrerun reads a local key file on the controller into _key
+func aptRepositoryPrerun(t *model.Task) (tr model.TaskResult) {
+	key := t.Args.String("key")
+	if key == "" || isURL(key) {
+		return model.TaskResult{Status: Skipped}
+	}
+	fh, err := vault.Open(key)
+	if err != nil {
+		return failure("cannot read key", key, err)
+	}
+	defer fh.Close()
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return failure("cannot read key", key, err)
+	}
+	t.Args["_key"] = string(data)
+	return model.TaskResult{Status: Success}
+}
+
+func aptRepository(t *model.Task) (tr model.TaskResult) {
+	name := t.Args.String("name")
+	if !aptRepoName.MatchString(name) {
+		return failure("invalid repository name", name)
+	}
+	sourcesPath := aptSourcesDir + "/" + name + ".sources"
+	keyPath := aptKeyringsDir + "/" + name + ".gpg"
+
+	lockTimeout, err := aptLockTimeout(t.Args)
+	if err != nil {
+		return failure(err)
+	}
+
+	tr.Status = Success
+
+	switch state := t.Args.String("state"); state {
+	case "absent":
+		for _, p := range []string{sourcesPath, keyPath} {
+			removed, err := removeFile(p, t.Notify)
+			if err != nil {
+				return failure(err)
+			}
+			tr.Changed = tr.Changed || removed
+		}
+
+	case "", "present":
+		files := []filesObj{}
+
+		signedBy := ""
+		if t.Args.String("key") != "" {
+			key, err := loadAptKey(t.Args)
+			if err != nil {
+				return failure("cannot load key", err)
+			}
+			files = append(files, filesObj{path: keyPath, data: key, mode: 0o644, notify: t.Notify})
+			signedBy = keyPath
+		}
+
+		sources, err := debSources(t.Args, signedBy)
+		if err != nil {
+			return failure(err)
+		}
+		files = append(files, filesObj{path: sourcesPath, data: []byte(sources), mode: 0o644, notify: t.Notify})
+
+		for _, f := range files {
+			if err := fs.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+				return failure(err)
+			}
+			changed, err := ensureFile(f)
+			if err != nil {
+				return failure(err)
+			}
+			if changed {
+				tr.Output += "updated " + f.path + "\n"
+			}
+			tr.Changed = tr.Changed || changed
+		}
+
+	default:
+		return failure("unknown state", state, "try present|absent")
+	}
+
+	if tr.Changed {
+		res := runAptGet("update", lockTimeout)
+		tr.Output += res.Output
+		if res.Status == Failed {
+			tr.Status = Failed
+		}
+	}
+	return tr
+}
+
+// debSources renders a deb822 sources file
+func debSources(args model.TaskArgs, signedBy string) (string, error) {
+	uris := args.StringSlice("uris")
+	if len(uris) == 0 {
+		return "", fmt.Errorf("uris is required")
+	}
+
+	suites := args.StringSlice("suites")
+	if len(suites) == 0 {
+		if facts["os_codename"] == "" {
+			return "", fmt.Errorf("no suites given, and cannot determine release codename")
+		}
+		suites = []string{facts["os_codename"]}
+	}
+
+	fields := []struct {
+		key    string
+		values []string
+		def    string
+	}{
+		{"Types", args.StringSlice("types"), "deb"},
+		{"URIs", uris, ""},
+		{"Suites", suites, ""},
+		{"Components", args.StringSlice("components"), "main"},
+		{"Architectures", args.StringSlice("architectures"), ""},
+		{"Signed-By", []string{signedBy}, ""},
+	}
+
+	var sb strings.Builder
+	for _, f := range fields {
+		values := f.values
+		if len(values) == 0 && f.def != "" {
+			values = []string{f.def}
+		}
+		v := strings.TrimSpace(strings.Join(values, " "))
+		if v == "" {
+			continue
+		}
+		fmt.Fprintf(&sb, "%s: %s\n", f.key, v)
+	}
+	return sb.String(), nil
+}
+
+// loadAptKey returns the binary key, either from the controller or a URL
+func loadAptKey(args model.TaskArgs) ([]byte, error) {
+	var data []byte
+	if key := args.String("key"); isURL(key) {
+		client := &http.Client{Timeout: keyFetchTimeout}
+		resp, err := client.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", key, resp.Status)
+		}
+		if data, err = io.ReadAll(resp.Body); err != nil {
+			return nil, err
+		}
+	} else {
+		data = []byte(args.String("_key"))
+	}
+
+	if len(data) == 0 {
+		return nil, fmt.Errorf("key %s is empty or could not be read", args.String("key"))
+	}
+	return dearmorKey(data)
+}
+
+// dearmorKey converts an ASCII armored OpenPGP key (RFC 4880, section 6.2)
+// to binary, like "gpg --dearmor". Binary keys are returned as is.
+func dearmorKey(data []byte) ([]byte, error) {
+	const begin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+	if !bytes.Contains(data, []byte(begin)) {
+		if data[0]&0x80 == 0 {
+			return nil, fmt.Errorf("key is neither armored nor binary OpenPGP")
+		}
+		return data, nil
+	}
+
+	var body, checksum strings.Builder
+	inBlock, inHeaders := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == begin:
+			inBlock, inHeaders = true, true
+		case !inBlock:
+			continue
+		case inHeaders:
+			// armor headers (such as "Comment: ...") end with an empty line
+			inHeaders = strings.Contains(line, ": ")
+			if !inHeaders && line != "" {
+				body.WriteString(line)
+			}
+		case strings.HasPrefix(line, "-----END"):
+			inBlock = false
+		case strings.HasPrefix(line, "=") && len(line) == 5:
+			checksum.WriteString(line[1:])
+		default:
+			body.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(body.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid armored key: %w", err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("armored key has no data")
+	}
+	if checksum.Len() > 0 {
+		sum, err := base64.StdEncoding.DecodeString(checksum.String())
+		if err != nil || len(sum) != 3 {
+			return nil, fmt.Errorf("invalid armor checksum")
+		}
+		if crc24(key) != uint32(sum[0])<<16|uint32(sum[1])<<8|uint32(sum[2]) {
+			return nil, fmt.Errorf("armor checksum mismatch")
+		}
+	}
+	return key, nil
+}
+
+// crc24 is the OpenPGP armor checksum
+func crc24(data []byte) uint32 {
+	crc := uint32(0xb704ce)
+	for _, b := range data {
+		crc ^= uint32(b) << 16
+		for i := 0; i < 8; i++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= 0x1864cfb
+			}
+		}
+	}
+	return crc & 0xffffff
+}
+
+// removeFile removes path (after a backup), if it exists
+func removeFile(path string, notify []string) (bool, error) {
+	if _, err := fs.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := backupFile(path, notify); err != nil {
+		return false, fmt.Errorf("backup error for %s: %w", path, err)
+	}
+	if err := fs.Remove(path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,94 @@
+package runners
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_dearmorKey(t *testing.T) {
+	want := append([]byte{0x99, 0x00, 0x0d}, "whip test key"...)
+
+	armored := `-----BEGIN PGP PUBLIC KEY BLOCK-----
+Comment: test
+
+mQANd2hp
+cCB0ZXN0IGtleQ==
+=tAbk
+-----END PGP PUBLIC KEY BLOCK-----
+`
+	key, err := dearmorKey([]byte(armored))
+	require.NoError(t, err)
+	assert.Equal(t, want, key)
+
+	key, err = dearmorKey(want)
+	require.NoError(t, err)
+	assert.Equal(t, want, key)
+
+	_, err = dearmorKey([]byte(strings.Replace(armored, "=tAbk", "=tAbl", 1)))
+	assert.ErrorContains(t, err, "checksum mismatch")
+
+	_, err = dearmorKey([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func Test_debSources(t *testing.T) {
+	oldFacts := facts
+	defer func() { facts = oldFacts }()
+	facts = map[string]string{"os_codename": "bookworm"}
+
+	got, err := debSources(model.TaskArgs{
+		"uris":       "https://nginx.org/packages/mainline/debian",
+		"components": "nginx",
+	}, "/etc/apt/keyrings/nginx.gpg")
+	require.NoError(t, err)
+	assert.Equal(t, `Types: deb
+URIs: https://nginx.org/packages/mainline/debian
+Suites: bookworm
+Components: nginx
+Signed-By: /etc/apt/keyrings/nginx.gpg
+`, got)
+
+	got, err = debSources(model.TaskArgs{
+		"uris":          "https://download.docker.com/linux/debian",
+		"suites":        []any{"bookworm", "trixie"},
+		"architectures": "amd64",
+	}, "")
+	require.NoError(t, err)
+	assert.Equal(t, `Types: deb
+URIs: https://download.docker.com/linux/debian
+Suites: bookworm trixie
+Components: main
+Architectures: amd64
+`, got)
+
+	_, err = debSources(model.TaskArgs{}, "")
+	assert.Error(t, err)
+}
+
+func Test_aptRepositoryAbsent(t *testing.T) {
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+	}()
+	createTestFS()
+
+	tr := aptRepository(&model.Task{Args: model.TaskArgs{"name": "nginx", "state": "absent"}})
+	assert.Equal(t, Success, tr.Status)
+	assert.False(t, tr.Changed)
+
+	tr = aptRepository(&model.Task{Args: model.TaskArgs{"name": "../nginx"}})
+	assert.Equal(t, Failed, tr.Status)
+}
+
+func Test_parseOSRelease(t *testing.T) {
+	kv := parseOSRelease("PRETTY_NAME=\"Debian GNU/Linux 12 (bookworm)\"\nID=debian\n# comment\nVERSION_CODENAME=bookworm\n")
+	assert.Equal(t, "debian", kv["ID"])
+	assert.Equal(t, "bookworm", kv["VERSION_CODENAME"])
+	assert.Equal(t, "Debian GNU/Linux 12 (bookworm)", kv["PRETTY_NAME"])
+}
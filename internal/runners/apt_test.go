@@ -12,23 +12,119 @@ https://manpages.ubuntu.com/manpages/xenial/man8/apt.8.html
 package runners
 
 import (
+	"strings"
 	"testing"
+	"time"
 
-	"github.com/gwillem/whip/internal/model"
 	"github.com/stretchr/testify/assert"
 )
 
-func Test_buildAptCmd(t *testing.T) {
-	args := model.TaskArgs{
-		"name":  []string{"foo", "bar", "mlocate state=absent"},
-		"state": "latest",
-	}
-	// want := aptPkgState(aptPkgState{"install": map[string]bool{"bar": true, "foo": true}})
-	want := aptPkgState{
-		"install": map[string]bool{"bar": true, "foo": true},
-		"remove":  map[string]bool{"mlocate": true},
-	}
-	got, err := buildWanted(args)
+func Test_parseDpkgQuery(t *testing.T) {
+	current := parseDpkgQuery(strings.Join([]string{
+		"curl\t7.88.1-10\tii ",
+		"php\t8.2.7\thi ",
+		"telnet\t0.17\trc ",
+	}, "\n"))
+	assert.Equal(t, map[string]pkgInstalled{
+		"curl":   {version: "7.88.1-10"},
+		"php":    {version: "8.2.7", held: true},
+		"telnet": {version: "0.17", configOnly: true},
+	}, current)
+}
+
+func Test_matchAptMadison(t *testing.T) {
+	data := `     nginx | 1.25.1-1~jammy | https://nginx.org/packages/ubuntu jammy/nginx amd64 Packages
+     nginx | 1.24.0-1~jammy | https://nginx.org/packages/ubuntu jammy/nginx amd64 Packages
+     nginx | 1.24.0-0ubuntu1 | http://archive.ubuntu.com/ubuntu jammy/main Sources
+     nginx | 1.18.0-6ubuntu14 | http://archive.ubuntu.com/ubuntu jammy-updates/main amd64 Packages
+`
+	v, ok := matchAptMadison(data, "1.24.*")
+	assert.True(t, ok)
+	assert.Equal(t, "1.24.0-1~jammy", v)
+
+	v, ok = matchAptMadison(data, "1.*")
+	assert.True(t, ok)
+	assert.Equal(t, "1.25.1-1~jammy", v)
+
+	_, ok = matchAptMadison(data, "1.22.*")
+	assert.False(t, ok)
+
+	v, err := aptVersion("nginx", "1.24.0-1~jammy")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.24.0-1~jammy", v, "exact versions are not resolved")
+}
+
+func Test_parseAptPolicy(t *testing.T) {
+	candidates := parseAptPolicy(`openssl:
+  Installed: 3.0.9-1
+  Candidate: 3.0.11-1
+  Version table:
+vim:
+  Installed: 9.0.1378
+  Candidate: 9.0.1378
+`)
+	assert.Equal(t, map[string]string{"openssl": "3.0.11-1", "vim": "9.0.1378"}, candidates)
+}
+
+func Test_aptChanged(t *testing.T) {
+	assert.True(t, aptChanged("Reading package lists...\n2 upgraded, 0 newly installed, 0 to remove and 3 not upgraded.\n"))
+	assert.True(t, aptChanged("0 upgraded, 1 newly installed, 0 to remove and 0 not upgraded.\n"))
+	assert.False(t, aptChanged("0 upgraded, 0 newly installed, 0 to remove and 5 not upgraded.\n"))
+	assert.False(t, aptChanged("E: Unable to locate package foo"))
+}
+
+func Test_aptCacheAge(t *testing.T) {
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+	}()
+	createTestFS()
+
+	assert.Greater(t, aptCacheAge(), 24*time.Hour)
+
+	assert.NoError(t, fsutil.WriteFile(aptListsDir+"/deb.debian.org_debian_dists_bookworm_InRelease", nil, 0o644))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, fs.Chtimes(aptListsDir+"/deb.debian.org_debian_dists_bookworm_InRelease", old, old))
+	assert.InDelta(t, 2*time.Hour, aptCacheAge(), float64(time.Minute))
+
+	assert.NoError(t, fsutil.WriteFile(aptUpdateStamp, nil, 0o644))
+	assert.Less(t, aptCacheAge(), time.Minute)
+}
+
+func Test_waitForDpkgLock(t *testing.T) {
+	oldHolder := dpkgLockHolder
+	defer func() { dpkgLockHolder = oldHolder }()
+
+	dpkgLockHolder = func(string) (int, error) { return 0, nil }
+	note, err := waitForDpkgLock(time.Second)
 	assert.NoError(t, err)
-	assert.Equal(t, want, got)
+	assert.Empty(t, note)
+
+	dpkgLockHolder = func(string) (int, error) { return 4242424, nil }
+	_, err = waitForDpkgLock(0)
+	assert.ErrorContains(t, err, "dpkg lock still held by pid 4242424")
+}
+
+func Test_dpkgInterrupted(t *testing.T) {
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+	}()
+	createTestFS()
+
+	assert.False(t, dpkgInterrupted())
+	assert.NoError(t, fs.MkdirAll(dpkgUpdatesDir, 0o755))
+	assert.False(t, dpkgInterrupted())
+	assert.NoError(t, fsutil.WriteFile(dpkgUpdatesDir+"/0001", nil, 0o644))
+	assert.True(t, dpkgInterrupted())
+}
+
+func Test_aptRetryable(t *testing.T) {
+	assert.True(t, aptRetryable("E: Could not get lock /var/lib/dpkg/lock-frontend. It is held by process 1234 (unattended-upgr)"))
+	assert.True(t, aptRetryable("E: dpkg was interrupted, you must manually run 'sudo dpkg --configure -a' to correct the problem."))
+	assert.False(t, aptRetryable("E: Unable to locate package foo"))
 }
@@ -19,5 +19,12 @@ func Command(t *model.Task) (tr model.TaskResult) {
 }
 
 func init() {
-	registerRunner("command", runner{run: Command})
+	registerRunner("command", runner{
+		run: Command,
+		meta: RunnerMeta{
+			Desc:     "Runs a command without a shell, so no pipes or redirects. Always reports changed.",
+			Args:     []Arg{{Name: parser.DefaultArg, Kind: ArgString, Required: true, Desc: "the command, such as: command: update-locale"}},
+			Examples: []string{"\n- command: systemctl daemon-reload\n"},
+		},
+	})
 }
@@ -0,0 +1,76 @@
+package runners
+
+import (
+	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+)
+
+// dnfManager is the pkgManager for RHEL, Fedora and derivatives. Older
+// systems with only yum work too, as the commands are the same.
+type dnfManager struct {
+	bin string
+}
+
+func newDnfManager(model.TaskArgs) (pkgManager, error) {
+	for _, bin := range []string{"/usr/bin/dnf", "/usr/bin/yum"} {
+		if isExecutable(bin) {
+			return dnfManager{bin: bin}, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot find dnf or yum")
+}
+
+func (m dnfManager) current() (map[string]pkgInstalled, error) {
+	data, err := exec.Command("rpm", "-qa", "--qf", `%{NAME}\t%{VERSION}-%{RELEASE}\n`).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("rpm -qa: %w\n%s", err, data)
+	}
+	return parseNameVersionLines(string(data), "\t"), nil
+}
+
+// upgradable uses check-update, which exits 100 if there are updates
+func (m dnfManager) upgradable(names []string, _ map[string]pkgInstalled) (map[string]bool, error) {
+	data, err := queryPkgManager([]int{0, 100}, append([]string{m.bin, "-q", "check-update"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parseDnfCheckUpdate(data), nil
+}
+
+// parseDnfCheckUpdate parses lines like "openssl.x86_64  1:3.0.7-25.el9  baseos"
+func parseDnfCheckUpdate(data string) map[string]bool {
+	upgradable := map[string]bool{}
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasSuffix(line, ":") {
+			continue
+		}
+		if i := strings.LastIndex(fields[0], "."); i > 0 {
+			upgradable[fields[0][:i]] = true
+		}
+	}
+	return upgradable
+}
+
+func (m dnfManager) apply(w pkgWork) model.TaskResult {
+	if len(w.hold)+len(w.unhold) > 0 {
+		return failure("hold is not supported for", m.bin)
+	}
+	install := []string{}
+	for _, p := range w.install {
+		if p.version != "" {
+			install = append(install, p.name+"-"+p.version)
+		} else {
+			install = append(install, p.name)
+		}
+	}
+	return runSteps([]pkgStep{
+		{m.bin + " -y -q install", install, runShell},
+		{m.bin + " -y -q upgrade", w.upgrade, runShell},
+		{m.bin + " -y -q remove", slices.Concat(w.remove, w.purge), runShell},
+	})
+}
@@ -8,7 +8,21 @@ import (
 )
 
 func init() {
-	registerRunner("get_url", runner{run: getURL})
+	registerRunner("get_url", runner{
+		run: getURL,
+		meta: RunnerMeta{
+			Desc: "Downloads a file, if it has changed",
+			Args: []Arg{
+				{Name: "url", Kind: ArgString, Required: true},
+				{Name: "dest", Kind: ArgString, Required: true, Desc: "path at the target"},
+			},
+			Examples: []string{`
+- get_url:
+    url: https://github.com/sansecio/composer/releases/latest/download/composer
+    dest: /usr/local/bin/composer
+`},
+		},
+	})
 }
 
 func getURL(t *model.Task) (tr model.TaskResult) {
@@ -0,0 +1,172 @@
+package runners
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+)
+
+// autoHandlerStates maps the action of an auto handler to a service state
+var autoHandlerStates = map[string]string{
+	"restart": "restarted",
+	"reload":  "reloaded",
+}
+
+// parseAutoHandler splits a notify name like "php8.2-fpm-reload" into
+// the service and its wanted state
+func parseAutoHandler(name string) (service, state string, ok bool) {
+	i := strings.LastIndex(name, "-")
+	if i <= 0 {
+		return "", "", false
+	}
+	state, ok = autoHandlerStates[name[i+1:]]
+	return name[:i], state, ok
+}
+
+// NotifyNames returns the handlers that a task can notify, including those
+// of the tree prefix attributes
+func NotifyNames(t model.Task) []string {
+	names := slices.Clone(t.Notify)
+	if t.Runner != "tree" {
+		return names
+	}
+	for prefix, v := range t.Args {
+		if s, ok := v.(string); ok && strings.HasPrefix(prefix, "/") {
+			names = append(names, parser.StringToSlice(parser.ParseArgString(s).String("notify"))...)
+		}
+	}
+	return names
+}
+
+// AutoHandlers returns service handlers for notify names of the form
+// <service>-<restart|reload> that have no defined handler in play. Like
+// defined handlers, they run after the tasks, and only if notified.
+func AutoHandlers(play model.Play) []model.Task {
+	defined := handlerTopics(play)
+
+	names := []string{}
+	for _, t := range model.FlattenTasks(play.Tasks) {
+		for _, n := range NotifyNames(t) {
+			if _, _, ok := parseAutoHandler(n); ok && !defined[n] && !slices.Contains(names, n) {
+				names = append(names, n)
+			}
+		}
+	}
+	slices.Sort(names)
+
+	return autoHandlers(names)
+}
+
+// UnhandledAutoHandlers returns service handlers for the notified names of
+// the form <service>-<restart|reload> that match none of handlers. These are
+// only known at runtime, such as the notify names restored by rollback.
+func UnhandledAutoHandlers(handlers []model.Task, notified map[string]bool) []model.Task {
+	names := []string{}
+	for n := range notified {
+		if _, _, ok := parseAutoHandler(n); ok && !slices.ContainsFunc(handlers, func(h model.Task) bool {
+			return Notified(h, map[string]bool{n: true})
+		}) {
+			names = append(names, n)
+		}
+	}
+	slices.Sort(names)
+	return autoHandlers(names)
+}
+
+func autoHandlers(names []string) []model.Task {
+	handlers := []model.Task{}
+	for _, n := range names {
+		service, state, _ := parseAutoHandler(n)
+		handlers = append(handlers, model.Task{
+			Name:   n,
+			Runner: "service",
+			Args:   model.TaskArgs{"name": service, "state": state},
+		})
+	}
+	return handlers
+}
+
+// handlerTopics returns the names and listen topics of the defined handlers
+func handlerTopics(play model.Play) map[string]bool {
+	topics := map[string]bool{}
+	for _, h := range play.Handlers {
+		topics[h.Name] = true
+		for _, l := range h.Listen {
+			topics[l] = true
+		}
+	}
+	return topics
+}
+
+// Notified reports whether handler h is triggered by any of the notified
+// names, either by its name or one of its listen topics
+func Notified(h model.Task, notified map[string]bool) bool {
+	if notified[h.Name] {
+		return true
+	}
+	for _, l := range h.Listen {
+		if notified[l] {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFlushHandlers reports whether t is the "meta: flush_handlers" task,
+// which runs the notified handlers halfway a play
+func IsFlushHandlers(t model.Task) bool {
+	return t.Runner == "meta" && t.Args.String(parser.DefaultArg) == "flush_handlers"
+}
+
+// UnknownHandlerError is returned by ValidateHandlers, with the task, so
+// the caller can report where it is defined
+type UnknownHandlerError struct {
+	Task    model.Task
+	Handler string
+}
+
+func (e *UnknownHandlerError) Error() string {
+	return fmt.Sprintf("task %q notifies unknown handler %q", taskName(e.Task), e.Handler)
+}
+
+// ValidateHandlers returns an error for notify names that match neither a
+// handler (by name or listen topic) nor an auto handler
+func ValidateHandlers(play model.Play) error {
+	topics := handlerTopics(play)
+	errs := []error{}
+	for _, t := range model.FlattenTasks(play.Tasks) {
+		for _, n := range NotifyNames(t) {
+			if _, _, auto := parseAutoHandler(n); n != "" && !topics[n] && !auto {
+				errs = append(errs, &UnknownHandlerError{Task: t, Handler: n})
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func taskName(t model.Task) string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.Runner
+}
+
+func metaRunner(t *model.Task) model.TaskResult {
+	// flush_handlers is run by the deputy itself
+	return failure("unknown meta action, try flush_handlers:", t.Args.String(parser.DefaultArg))
+}
+
+func init() {
+	registerRunner("meta", runner{
+		run: metaRunner,
+		meta: RunnerMeta{
+			Desc:     "Controls the play. flush_handlers runs the notified handlers now, instead of at the end of the play.",
+			Args:     []Arg{{Name: parser.DefaultArg, Kind: ArgString, Required: true, Enum: []string{"flush_handlers"}}},
+			Examples: []string{"\n- meta: flush_handlers\n"},
+		},
+	})
+}
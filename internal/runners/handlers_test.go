@@ -0,0 +1,103 @@
+package runners
+
+import (
+	"testing"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseAutoHandler(t *testing.T) {
+	service, state, ok := parseAutoHandler("php8.2-fpm-reload")
+	assert.True(t, ok)
+	assert.Equal(t, "php8.2-fpm", service)
+	assert.Equal(t, "reloaded", state)
+
+	for _, name := range []string{"nginx", "nginx-stop", "-restart", ""} {
+		_, _, ok := parseAutoHandler(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func Test_AutoHandlers(t *testing.T) {
+	play := model.Play{
+		Tasks: []model.Task{
+			{Runner: "tree", Notify: []string{"nginx-reload"}, Args: model.TaskArgs{
+				"src":              "files",
+				"/etc/php":         "notify=php-fpm-restart",
+				"/etc/nginx/certs": "mode=0600 notify=nginx-reload,haproxy-reload",
+			}},
+			{Runner: "command", Notify: []string{"sync", "mysql-restart"}},
+		},
+		Handlers: []model.Task{{Name: "mysql-restart", Runner: "command"}},
+	}
+
+	want := []model.Task{
+		{Name: "haproxy-reload", Runner: "service", Args: model.TaskArgs{"name": "haproxy", "state": "reloaded"}},
+		{Name: "nginx-reload", Runner: "service", Args: model.TaskArgs{"name": "nginx", "state": "reloaded"}},
+		{Name: "php-fpm-restart", Runner: "service", Args: model.TaskArgs{"name": "php-fpm", "state": "restarted"}},
+	}
+	assert.Equal(t, want, AutoHandlers(play))
+}
+
+func Test_handlerTopics(t *testing.T) {
+	play := model.Play{
+		Tasks: []model.Task{
+			{Name: "config", Runner: "command", Notify: []string{"web-config", "nginx-reload"}},
+			{Runner: "meta", Args: model.TaskArgs{"_args": "flush_handlers"}},
+		},
+		Handlers: []model.Task{
+			{Name: "restart php", Runner: "command", Listen: []string{"web-config"}},
+			{Name: "nginx-reload", Runner: "command", Listen: []string{"web-config"}},
+		},
+	}
+
+	assert.True(t, Notified(play.Handlers[0], map[string]bool{"web-config": true}))
+	assert.True(t, Notified(play.Handlers[1], map[string]bool{"nginx-reload": true}))
+	assert.False(t, Notified(play.Handlers[0], map[string]bool{"nginx-reload": true}))
+
+	assert.Empty(t, AutoHandlers(play))
+	assert.NoError(t, ValidateHandlers(play))
+	assert.False(t, IsFlushHandlers(play.Tasks[0]))
+	assert.True(t, IsFlushHandlers(play.Tasks[1]))
+
+	play.Tasks[0].Notify = append(play.Tasks[0].Notify, "restart-php")
+	assert.EqualError(t, ValidateHandlers(play), `task "config" notifies unknown handler "restart-php"`)
+}
+
+func Test_UnhandledAutoHandlers(t *testing.T) {
+	log.SetLevel(log.LevelError)
+	defer log.SetLevel(log.LevelDebug)
+
+	oldFs, oldFsutil := fs, fsutil
+	defer func() {
+		fs, fsutil = oldFs, oldFsutil
+		SetRunID("")
+	}()
+	createTestFS()
+
+	// the rollback play has no tasks that notify nginx-reload, so the
+	// handler is only known from the result of the rollback
+	SetRunID("run1")
+	changed, err := ensureFile(filesObj{path: "/etc/nginx/nginx.conf", data: []byte("new"), mode: 0o644, notify: []string{"nginx-reload"}})
+	require.NoError(t, err)
+	require.True(t, changed)
+	require.NoError(t, FinishRun())
+
+	play := model.Play{Tasks: []model.Task{{Runner: "rollback", Args: model.TaskArgs{"run_id": "run1"}}}}
+	assert.Empty(t, AutoHandlers(play))
+
+	SetRunID("run2")
+	tr := rollback(&play.Tasks[0])
+	require.Equal(t, Success, tr.Status, tr.Output)
+
+	want := []model.Task{{Name: "nginx-reload", Runner: "service", Args: model.TaskArgs{"name": "nginx", "state": "reloaded"}}}
+	assert.Equal(t, want, UnhandledAutoHandlers(nil, tr.Notify))
+
+	// a defined handler (or listen topic) takes precedence
+	defined := []model.Task{{Name: "reload nginx", Runner: "command", Listen: []string{"nginx-reload"}}}
+	assert.Empty(t, UnhandledAutoHandlers(defined, tr.Notify))
+	assert.Empty(t, UnhandledAutoHandlers(nil, map[string]bool{"nginx": true}))
+}
@@ -3,7 +3,21 @@ package runners
 import "github.com/gwillem/whip/internal/model"
 
 func init() {
-	registerRunner("lineinfile", runner{run: LineInFile})
+	registerRunner("lineinfile", runner{
+		run: LineInFile,
+		meta: RunnerMeta{
+			Desc: "Adds a line to a file, if it isn't there yet",
+			Args: []Arg{
+				{Name: "path", Kind: ArgString, Required: true},
+				{Name: "line", Kind: ArgString, Required: true},
+			},
+			Examples: []string{`
+- lineinfile:
+    path: /etc/hosts
+    line: 10.0.0.2 db
+`},
+		},
+	})
 }
 
 func LineInFile(t *model.Task) (tr model.TaskResult) {
@@ -0,0 +1,380 @@
+package runners
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+)
+
+// The package runners (apt, dnf, apk, pacman and the generic "package")
+// share the wanted vs current logic. A pkgManager only needs to report the
+// current state and apply the work.
+
+type pkgManager interface {
+	// current returns the installed packages
+	current() (map[string]pkgInstalled, error)
+	// upgradable returns which of names have a newer version available
+	upgradable(names []string, current map[string]pkgInstalled) (map[string]bool, error)
+	// apply performs the work, and reports changed if anything was done
+	apply(w pkgWork) model.TaskResult
+}
+
+// pkgNormalizer is implemented by package managers with case or
+// punctuation insensitive names
+type pkgNormalizer interface {
+	normalize(name string) string
+}
+
+// pkgLineParser is implemented by package managers with their own version
+// syntax, such as pip. It returns the spec and the attributes of a line.
+type pkgLineParser interface {
+	parseLine(line string) (pkgSpec, string, error)
+}
+
+const (
+	installed = "install"
+	latest    = "latest"
+	removed   = "remove"
+	purged    = "purge"
+)
+
+var pkgStateMap = map[string]string{
+	"present": installed,
+	"latest":  latest,
+	"absent":  removed,
+	"purged":  purged,
+}
+
+// args that are shared by the package runners
+var (
+	pkgNameArg     = Arg{Name: "name", Kind: ArgList, Desc: "packages, with optional =version and per package state= and hold="}
+	stateArg       = Arg{Name: "state", Kind: ArgString, Enum: []string{"present", "latest", "absent", "purged"}, Default: "present", Desc: "for all packages"}
+	holdArg        = Arg{Name: "hold", Kind: ArgBool, Desc: "hold all packages at their version"}
+	lockTimeoutArg = Arg{Name: "lock_timeout", Kind: ArgInt, Default: "300", Desc: "seconds to wait for the dpkg lock"}
+)
+
+// pkgManagers maps a package manager to a constructor and the os ids
+// (from /etc/os-release ID or ID_LIKE) that use it
+var pkgManagers = map[string]struct {
+	osIDs []string
+	init  func(model.TaskArgs) (pkgManager, error)
+}{
+	"apt":    {[]string{"debian", "ubuntu"}, newAptManager},
+	"dnf":    {[]string{"rhel", "fedora", "centos", "rocky", "almalinux"}, newDnfManager},
+	"apk":    {[]string{"alpine"}, newApkManager},
+	"pacman": {[]string{"arch"}, newPacmanManager},
+}
+
+// pkgSpec is a wanted package, from a line such as "nginx=1.24.* hold=yes"
+type pkgSpec struct {
+	name    string
+	state   string
+	version string // glob, matched against the installed version
+	hold    *bool
+	req     string // what to install, if more than name and version (pip)
+}
+
+// pkgInstalled is the current state of an installed package
+type pkgInstalled struct {
+	version    string
+	held       bool
+	configOnly bool // removed, but its config files are left, so it can be purged
+}
+
+// pkgVersion is a package to install, with an optional version glob
+type pkgVersion struct {
+	name    string
+	version string
+	req     string
+}
+
+// pkgWork is what the package manager needs to do to get from current to wanted
+type pkgWork struct {
+	install []pkgVersion // missing or wrong version
+	upgrade []string     // outdated, for state=latest
+	remove  []string
+	purge   []string
+	hold    []string
+	unhold  []string
+}
+
+func (w pkgWork) empty() bool {
+	return len(w.install)+len(w.upgrade)+len(w.remove)+len(w.purge)+len(w.hold)+len(w.unhold) == 0
+}
+
+func getState(s string) string {
+	if val := pkgStateMap[s]; val != "" {
+		return val
+	}
+	return installed
+}
+
+// parsePkgLine splits a line such as "nginx=1.24.* hold=yes" into the
+// package spec and its attributes
+func parsePkgLine(line string) (pkgSpec, string, error) {
+	spec, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+	p := pkgSpec{}
+	p.name, p.version, _ = strings.Cut(spec, "=")
+	return p, rest, nil
+}
+
+// buildWanted parses the package lines in args, with the line syntax of pm
+// if it has its own
+func buildWanted(args model.TaskArgs, pm pkgManager) ([]pkgSpec, error) {
+	parseLine := parsePkgLine
+	if lp, ok := pm.(pkgLineParser); ok {
+		parseLine = lp.parseLine
+	}
+
+	pkgs := []pkgSpec{}
+	defaultState := getState(args.String("state"))
+	var defaultHold *bool
+	if args["hold"] != nil {
+		h := args.Bool("hold")
+		defaultHold = &h
+	}
+
+	for _, line := range args.StringSlice("name") {
+		p, rest, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		attrs := parser.ParseArgString(rest)
+		if extra := attrs.String(parser.DefaultArg); extra != "" {
+			return nil, fmt.Errorf("invalid package line %q", line)
+		}
+
+		p.state, p.hold = defaultState, defaultHold
+		if p.name == "" {
+			return nil, fmt.Errorf("invalid package line %q", line)
+		}
+		if s := attrs.String("state"); s != "" {
+			if pkgStateMap[s] == "" {
+				return nil, fmt.Errorf("unknown state %s for %s, try present|latest|absent|purged", s, p.name)
+			}
+			p.state = getState(s)
+		}
+		if attrs["hold"] != nil {
+			h := attrs.Bool("hold")
+			p.hold = &h
+		}
+		pkgs = append(pkgs, p)
+	}
+	return pkgs, nil
+}
+
+func buildWork(wanted []pkgSpec, current map[string]pkgInstalled, upgradable map[string]bool) pkgWork {
+	w := pkgWork{}
+	for _, p := range wanted {
+		cur, known := current[p.name]
+		isInstalled := known && !cur.configOnly
+
+		switch p.state {
+		case removed, purged:
+			if isInstalled && p.state == removed {
+				w.remove = append(w.remove, p.name)
+			} else if known && p.state == purged {
+				w.purge = append(w.purge, p.name)
+			}
+			continue // no hold for removed pkgs
+
+		case installed, latest:
+			switch {
+			case p.version != "":
+				if ok, _ := path.Match(p.version, cur.version); !isInstalled || !ok {
+					w.install = append(w.install, pkgVersion{p.name, p.version, p.req})
+				}
+			case !isInstalled:
+				w.install = append(w.install, pkgVersion{name: p.name, req: p.req})
+			case p.state == latest && upgradable[p.name]:
+				w.upgrade = append(w.upgrade, p.name)
+			}
+		}
+
+		if p.hold != nil && *p.hold && !cur.held {
+			w.hold = append(w.hold, p.name)
+		} else if p.hold != nil && !*p.hold && cur.held {
+			w.unhold = append(w.unhold, p.name)
+		}
+	}
+	return w
+}
+
+// ensurePackages brings the packages in args to their wanted state
+func ensurePackages(pm pkgManager, args model.TaskArgs) model.TaskResult {
+	wanted, err := buildWanted(args, pm)
+	if err != nil {
+		return failure("cannot get wanted package state", err)
+	}
+	if len(wanted) == 0 {
+		return model.TaskResult{Status: Success}
+	}
+
+	if n, ok := pm.(pkgNormalizer); ok {
+		for i := range wanted {
+			wanted[i].name = n.normalize(wanted[i].name)
+		}
+	}
+
+	current, err := pm.current()
+	if err != nil {
+		return failure("cannot get current package state", err)
+	}
+
+	latestPkgs := []string{}
+	for _, p := range wanted {
+		if cur, ok := current[p.name]; ok && !cur.configOnly && p.state == latest && p.version == "" {
+			latestPkgs = append(latestPkgs, p.name)
+		}
+	}
+	upgradable := map[string]bool{}
+	if len(latestPkgs) > 0 {
+		if upgradable, err = pm.upgradable(latestPkgs, current); err != nil {
+			return failure("cannot get upgradable packages", err)
+		}
+	}
+
+	work := buildWork(wanted, current, upgradable)
+	log.Debug("package work", work)
+	if work.empty() {
+		return model.TaskResult{Status: Success}
+	}
+	return pm.apply(work)
+}
+
+// detectPkgManager picks the package manager for this system from facts
+func detectPkgManager(facts map[string]string) (string, error) {
+	ids := append([]string{facts["os_id"]}, strings.Fields(facts["os_id_like"])...)
+	for _, id := range ids {
+		for name, pm := range pkgManagers {
+			if slices.Contains(pm.osIDs, id) {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no package manager known for os %q", facts["os_id"])
+}
+
+// runSteps runs a sequence of package manager commands, and stops at the
+// first failure. Steps without packages are skipped.
+func runSteps(steps []pkgStep) (tr model.TaskResult) {
+	tr.Status = Success
+	for _, step := range steps {
+		if len(step.pkgs) == 0 {
+			continue
+		}
+		quoted := []string{}
+		for _, p := range step.pkgs {
+			quoted = append(quoted, shellQuote(p))
+		}
+		res := step.run(step.cmd + " " + strings.Join(quoted, " "))
+		tr.Output += res.Output
+		tr.Changed = tr.Changed || res.Changed
+		if res.Status == Failed {
+			tr.Status = Failed
+			return tr
+		}
+	}
+	return tr
+}
+
+// queryPkgManager runs a read-only command, which may exit with any of okCodes
+func queryPkgManager(okCodes []int, cmd ...string) (string, error) {
+	data, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && slices.Contains(okCodes, exitErr.ExitCode()) {
+		err = nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s: %w\n%s", strings.Join(cmd, " "), err, data)
+	}
+	return string(data), nil
+}
+
+// parseNameVersionLines parses lines of "name<sep>version"
+func parseNameVersionLines(data, sep string) map[string]pkgInstalled {
+	pkgs := map[string]pkgInstalled{}
+	for _, line := range strings.Split(data, "\n") {
+		name, version, ok := strings.Cut(strings.TrimSpace(line), sep)
+		if !ok || name == "" {
+			continue
+		}
+		pkgs[name] = pkgInstalled{version: strings.TrimSpace(version)}
+	}
+	return pkgs
+}
+
+type pkgStep struct {
+	cmd  string
+	pkgs []string
+	run  func(cmd string) model.TaskResult
+}
+
+// packageRunner is the distro agnostic runner, which uses the native
+// package manager of the target (or the one given with "use")
+func packageRunner(t *model.Task) (tr model.TaskResult) {
+	name := t.Args.String("use")
+	if name == "" || name == "auto" {
+		var err error
+		if name, err = detectPkgManager(facts); err != nil {
+			return failure(err)
+		}
+	}
+	return runPkgManager(name, t.Args)
+}
+
+func runPkgManager(name string, args model.TaskArgs) model.TaskResult {
+	pm, ok := pkgManagers[name]
+	if !ok {
+		return failure("unknown package manager", name)
+	}
+	mgr, err := pm.init(args)
+	if err != nil {
+		return failure(err)
+	}
+	return ensurePackages(mgr, args)
+}
+
+func init() {
+	registerRunner("package", runner{
+		run: packageRunner,
+		meta: RunnerMeta{
+			Desc: "Manages packages with the package manager of the target (apt, dnf, apk or pacman)",
+			Args: []Arg{
+				{Name: "name", Kind: ArgList, Required: true, Desc: pkgNameArg.Desc},
+				stateArg,
+				holdArg,
+				{Name: "use", Kind: ArgString, Enum: []string{"auto", "apt", "dnf", "apk", "pacman"}, Default: "auto", Desc: "package manager, auto detects it from /etc/os-release"},
+				lockTimeoutArg,
+			},
+			Examples: []string{`
+- package:
+    name: git, curl
+    state: latest
+`},
+		},
+	})
+
+	// apt has its own runner, with cache and upgrade support
+	for _, name := range []string{"dnf", "apk", "pacman"} {
+		registerRunner(name, runner{
+			run: func(t *model.Task) model.TaskResult { return runPkgManager(name, t.Args) },
+			meta: RunnerMeta{
+				Desc: "Installs, upgrades, removes and holds packages with " + name,
+				Args: []Arg{
+					{Name: "name", Kind: ArgList, Required: true, Desc: pkgNameArg.Desc},
+					stateArg,
+					holdArg,
+				},
+				Examples: []string{"\n- " + name + ":\n    name: [git, curl]\n"},
+			},
+		})
+	}
+}
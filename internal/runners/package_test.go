@@ -0,0 +1,117 @@
+package runners
+
+import (
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_buildWanted(t *testing.T) {
+	args := model.TaskArgs{
+		"name":  []string{"foo", "bar", "mlocate state=absent", "nginx=1.24.* hold=yes"},
+		"state": "latest",
+	}
+	yes := true
+	want := []pkgSpec{
+		{name: "foo", state: latest},
+		{name: "bar", state: latest},
+		{name: "mlocate", state: removed},
+		{name: "nginx", state: latest, version: "1.24.*", hold: &yes},
+	}
+	got, err := buildWanted(args, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+
+	_, err = buildWanted(model.TaskArgs{"name": "foo state=newest"}, nil)
+	assert.Error(t, err)
+}
+
+func Test_buildWork(t *testing.T) {
+	yes, no := true, false
+	wanted := []pkgSpec{
+		{name: "curl", state: installed},                                 // already there
+		{name: "git", state: installed},                                  // missing
+		{name: "nginx", state: installed, version: "1.24.*", hold: &yes}, // wrong version
+		{name: "php", state: installed, version: "8.2*", hold: &no},      // right version, but held
+		{name: "openssl", state: latest},                                 // outdated
+		{name: "vim", state: latest},                                     // up to date
+		{name: "mlocate", state: removed},
+		{name: "snapd", state: purged},
+		{name: "telnet", state: removed}, // not installed
+		{name: "ftp", state: purged},     // only config files left
+		{name: "mc", state: removed},     // only config files left
+		{name: "mutt", state: installed}, // only config files left
+	}
+	current := map[string]pkgInstalled{
+		"curl":    {version: "7.88.1-10"},
+		"nginx":   {version: "1.22.1-9"},
+		"php":     {version: "8.2.7", held: true},
+		"openssl": {version: "3.0.9-1"},
+		"vim":     {version: "9.0.1378"},
+		"mlocate": {version: "1.1.18"},
+		"snapd":   {version: "2.58"},
+		"ftp":     {version: "20210827-4", configOnly: true},
+		"mc":      {version: "3:4.8.28-1", configOnly: true},
+		"mutt":    {version: "2.2.1-1", configOnly: true},
+	}
+	upgradable := map[string]bool{"openssl": true, "vim": false}
+
+	want := pkgWork{
+		install: []pkgVersion{{name: "git"}, {name: "nginx", version: "1.24.*"}, {name: "mutt"}},
+		upgrade: []string{"openssl"},
+		remove:  []string{"mlocate"},
+		purge:   []string{"snapd", "ftp"},
+		hold:    []string{"nginx"},
+		unhold:  []string{"php"},
+	}
+	assert.Equal(t, want, buildWork(wanted, current, upgradable))
+	assert.True(t, pkgWork{}.empty())
+}
+
+func Test_detectPkgManager(t *testing.T) {
+	for facts, want := range map[[2]string]string{
+		{"debian", ""}:                  "apt",
+		{"linuxmint", "ubuntu debian"}:  "apt",
+		{"rocky", "rhel centos fedora"}: "dnf",
+		{"alpine", ""}:                  "apk",
+		{"endeavouros", "arch"}:         "pacman",
+	} {
+		got, err := detectPkgManager(map[string]string{"os_id": facts[0], "os_id_like": facts[1]})
+		require.NoError(t, err)
+		assert.Equal(t, want, got, facts)
+	}
+
+	_, err := detectPkgManager(map[string]string{"os_id": "gentoo"})
+	assert.Error(t, err)
+}
+
+func Test_parseDnfCheckUpdate(t *testing.T) {
+	got := parseDnfCheckUpdate(`
+openssl.x86_64                 1:3.0.7-25.el9_3                 baseos
+openssl-libs.x86_64            1:3.0.7-25.el9_3                 baseos
+Obsoleting Packages
+`)
+	assert.Equal(t, map[string]bool{"openssl": true, "openssl-libs": true}, got)
+}
+
+func Test_parseApkPackages(t *testing.T) {
+	got := parseApkPackages("busybox-1.36.1-r5\nlibcrypto3-3.1.4-r1 < 3.1.4-r5\nWARNING: something\n")
+	assert.Equal(t, map[string]pkgInstalled{
+		"busybox":    {version: "1.36.1-r5"},
+		"libcrypto3": {version: "3.1.4-r1"},
+	}, got)
+
+	assert.Equal(t, "nginx", apkVersion(pkgVersion{name: "nginx"}))
+	assert.Equal(t, "nginx=1.24.0-r6", apkVersion(pkgVersion{name: "nginx", version: "1.24.0-r6"}))
+	assert.Equal(t, "nginx~1.24", apkVersion(pkgVersion{name: "nginx", version: "1.24.*"}))
+}
+
+func Test_parseNameVersionLines(t *testing.T) {
+	got := parseNameVersionLines("bash 5.2.026-2\nopenssl 3.2.1-1 -> 3.2.1-2\n", " ")
+	assert.Equal(t, map[string]pkgInstalled{
+		"bash":    {version: "5.2.026-2"},
+		"openssl": {version: "3.2.1-1 -> 3.2.1-2"},
+	}, got)
+}
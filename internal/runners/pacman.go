@@ -0,0 +1,60 @@
+package runners
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gwillem/whip/internal/model"
+)
+
+const pacmanBin = "/usr/bin/pacman"
+
+// pacmanManager is the pkgManager for Arch
+type pacmanManager struct{}
+
+func newPacmanManager(model.TaskArgs) (pkgManager, error) {
+	if !isExecutable(pacmanBin) {
+		return nil, fmt.Errorf("cannot run %s", pacmanBin)
+	}
+	return pacmanManager{}, nil
+}
+
+func (m pacmanManager) current() (map[string]pkgInstalled, error) {
+	data, err := queryPkgManager([]int{0}, pacmanBin, "-Q")
+	if err != nil {
+		return nil, err
+	}
+	return parseNameVersionLines(data, " "), nil
+}
+
+// upgradable uses -Qu, which prints "name old -> new" and exits 1 if
+// there are no updates
+func (m pacmanManager) upgradable(names []string, _ map[string]pkgInstalled) (map[string]bool, error) {
+	data, err := queryPkgManager([]int{0, 1}, append([]string{pacmanBin, "-Qu"}, names...)...)
+	if err != nil {
+		return nil, err
+	}
+	upgradable := map[string]bool{}
+	for name := range parseNameVersionLines(data, " ") {
+		upgradable[name] = true
+	}
+	return upgradable, nil
+}
+
+func (m pacmanManager) apply(w pkgWork) model.TaskResult {
+	if len(w.hold)+len(w.unhold) > 0 {
+		return failure("hold is not supported for pacman")
+	}
+	install := []string{}
+	for _, p := range w.install {
+		if p.version != "" {
+			return failure("versions are not supported for pacman:", p.name+"="+p.version)
+		}
+		install = append(install, p.name)
+	}
+	return runSteps([]pkgStep{
+		{pacmanBin + " -S --needed --noconfirm", slices.Concat(install, w.upgrade), runShell},
+		{pacmanBin + " -R --noconfirm", w.remove, runShell},
+		{pacmanBin + " -Rns --noconfirm", w.purge, runShell},
+	})
+}
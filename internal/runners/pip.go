@@ -0,0 +1,384 @@
+package runners
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/vault"
+)
+
+/*
+
+pip installs Python packages into a virtualenv, which is created if missing.
+Packages are pip (PEP 508) requirements, followed by the same per line
+attributes as apt:
+
+	- pip:
+	    virtualenv: /srv/app/venv
+	    requirements: files/app/requirements.txt
+	    name:
+	      - requests[socks]==2.31.*
+	      - flask>=3.0
+	      - gunicorn state=latest
+	      - pycrypto state=absent
+
+Only == pins are compared with the installed version, other specifiers and
+markers are left to pip. Whether anything changed is decided by comparing
+"pip list" before and after.
+
+The requirements file is read on the controller (and may be vaulted),
+including the files it refers to with -r.
+
+*/
+
+var (
+	pipNameSeparators = regexp.MustCompile(`[-_.]+`)
+
+	// pipReq matches a PEP 508 requirement: name, extras, version specifier
+	// (or @ url) and environment marker
+	pipReq = regexp.MustCompile(`^([A-Za-z0-9](?:[A-Za-z0-9._-]*[A-Za-z0-9])?)\s*(\[[^\]]*\])?\s*([^;]*?)\s*(;.*)?$`)
+	pipPin = regexp.MustCompile(`^==\s*([^=,\s]+)$`)
+	// pipAttr matches a whip attribute at the end of a requirement
+	pipAttr = regexp.MustCompile(`\s+((?:state|hold)=\S+)$`)
+)
+
+const maxRequirementsDepth = 10
+
+func init() {
+	registerRunner("pip", runner{
+		run:    pip,
+		prerun: pipPrerun,
+		meta: RunnerMeta{
+			Desc: "Installs Python packages into a virtualenv, which is created if missing",
+			Args: []Arg{
+				{Name: "virtualenv", Kind: ArgString, Required: true, Desc: "absolute path"},
+				{Name: "name", Kind: ArgList, Desc: "pip requirements, such as flask>=3.0, with per package state="},
+				{Name: "requirements", Kind: ArgString, Desc: "requirements file on the controller, may be vaulted"},
+				stateArg,
+				{Name: "python", Kind: ArgString, Default: "python3", Desc: "to create the virtualenv with"},
+			},
+			Examples: []string{`
+- pip:
+    virtualenv: /srv/app/venv
+    name:
+      - requests[socks]==2.31.*
+      - flask>=3.0
+      - gunicorn state=latest
+`},
+		},
+	})
+}
+
+// pipManager is the pkgManager for a virtualenv
+type pipManager struct {
+	pip     string
+	options []string // from the requirements file, such as --index-url
+}
+
+// pipRequirements are the lines of a requirements file
+type pipRequirements struct {
+	specs    []string
+	options  []string // such as --index-url URL, passed to every install
+	editable []string // -e paths or urls, always passed to pip
+}
+
+// pipPrerun reads the requirements file on the controller into
+// _requirements, including the files it refers to with -r
+func pipPrerun(t *model.Task) (tr model.TaskResult) {
+	path := t.Args.String("requirements")
+	if path == "" {
+		return model.TaskResult{Status: Skipped}
+	}
+	data, err := readRequirements(path, 0)
+	if err != nil {
+		return failure("cannot read requirements", path, err)
+	}
+	t.Args["_requirements"] = data
+	return model.TaskResult{Status: Success}
+}
+
+// readRequirements reads a requirements file and replaces its -r lines with
+// the contents of the file they refer to, relative to the including file
+func readRequirements(path string, depth int) (string, error) {
+	if depth > maxRequirementsDepth {
+		return "", fmt.Errorf("requirements nested too deep at %s", path)
+	}
+	fh, err := vault.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return "", err
+	}
+
+	out := []string{}
+	for _, line := range requirementLines(string(data)) {
+		opt, arg := splitPipOption(line)
+		if opt != "-r" && opt != "--requirement" {
+			out = append(out, line)
+			continue
+		}
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(filepath.Dir(path), arg)
+		}
+		included, err := readRequirements(arg, depth+1)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, included)
+	}
+	return strings.Join(out, "\n"), nil
+}
+
+func pip(t *model.Task) (tr model.TaskResult) {
+	venv := t.Args.String("virtualenv")
+	if !filepath.IsAbs(venv) {
+		return failure("virtualenv should be an absolute path:", venv)
+	}
+
+	names := t.Args.StringSlice("name")
+	reqs := pipRequirements{}
+	if t.Args.String("requirements") != "" {
+		if t.Args["_requirements"] == nil {
+			return failure("requirements file was not loaded:", t.Args.String("requirements"))
+		}
+		var err error
+		if reqs, err = parseRequirements(t.Args.String("_requirements")); err != nil {
+			return failure(t.Args.String("requirements"), err)
+		}
+		names = append(names, reqs.specs...)
+	}
+
+	tr.Status = Success
+	pm := pipManager{pip: filepath.Join(venv, "bin", "pip"), options: reqs.options}
+	if !isExecutable(pm.pip) {
+		python := t.Args.String("python")
+		if python == "" {
+			python = "python3"
+		}
+		res := runShell(shellQuote(python) + " -m venv " + shellQuote(venv))
+		if res.Status == Failed {
+			return res
+		}
+		tr.Changed = true
+		tr.Output = "created virtualenv " + venv + "\n"
+	}
+
+	args := model.TaskArgs{"name": names, "state": t.Args["state"]}
+	res := ensurePackages(pm, args)
+	if res.Status != Failed && len(reqs.editable) > 0 {
+		editable := []string{}
+		for _, e := range reqs.editable {
+			editable = append(editable, "-e", e)
+		}
+		eres := pm.run([]pkgStep{{pm.cmd("install"), editable, runShell}})
+		eres.Changed = eres.Changed || res.Changed
+		eres.Output = res.Output + eres.Output
+		res = eres
+	}
+	res.Changed = res.Changed || tr.Changed
+	res.Output = tr.Output + res.Output
+	return res
+}
+
+// requirementLines returns the lines of a requirements file, with
+// continuations joined and without comments and blank lines
+func requirementLines(data string) []string {
+	lines := []string{}
+	data = strings.ReplaceAll(data, "\\\n", "")
+	for _, line := range strings.Split(data, "\n") {
+		// a comment starts a line or follows whitespace, urls can have #
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.Index(line, " #"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// splitPipOption returns the option and its argument of a line such as
+// "--index-url URL", "-e ." or "--index-url=URL"
+func splitPipOption(line string) (string, string) {
+	if !strings.HasPrefix(line, "-") {
+		return "", ""
+	}
+	opt, arg, found := strings.Cut(line, " ")
+	if !found {
+		opt, arg, _ = strings.Cut(line, "=")
+	}
+	return opt, strings.TrimSpace(arg)
+}
+
+// parseRequirements parses a requirements file, of which the -r lines have
+// been included by the prerun
+func parseRequirements(data string) (pipRequirements, error) {
+	reqs := pipRequirements{}
+	for _, line := range requirementLines(data) {
+		opt, arg := splitPipOption(line)
+		switch opt {
+		case "":
+			if strings.Contains(line, " --") {
+				return reqs, fmt.Errorf("per requirement options, such as --hash, are not supported: %s", line)
+			}
+			reqs.specs = append(reqs.specs, line)
+		case "-e", "--editable":
+			reqs.editable = append(reqs.editable, arg)
+		case "-r", "--requirement":
+			return reqs, fmt.Errorf("requirements file %s was not included", arg)
+		case "-c", "--constraint":
+			return reqs, fmt.Errorf("constraints files are not supported: %s", line)
+		default:
+			reqs.options = append(reqs.options, opt)
+			if arg != "" {
+				reqs.options = append(reqs.options, arg)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+// parseLine parses a PEP 508 requirement, followed by attributes such as
+// state=latest. Only a single == specifier is used as version, the
+// requirement is passed to pip as is.
+func (m pipManager) parseLine(line string) (pkgSpec, string, error) {
+	line = strings.TrimSpace(line)
+	attrs := []string{}
+	for {
+		loc := pipAttr.FindStringSubmatchIndex(line)
+		if loc == nil {
+			break
+		}
+		attrs = append([]string{line[loc[2]:loc[3]]}, attrs...)
+		line = strings.TrimSpace(line[:loc[0]])
+	}
+
+	match := pipReq.FindStringSubmatch(line)
+	if match == nil {
+		return pkgSpec{}, "", fmt.Errorf("invalid requirement %q", line)
+	}
+	p := pkgSpec{name: match[1], req: line}
+	if pin := pipPin.FindStringSubmatch(match[3]); pin != nil {
+		p.version = pin[1]
+	}
+	return p, strings.Join(attrs, " "), nil
+}
+
+// normalize returns the canonical name of a Python package (PEP 503)
+func (m pipManager) normalize(name string) string {
+	return strings.ToLower(pipNameSeparators.ReplaceAllString(name, "-"))
+}
+
+type pipListEntry struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+func (m pipManager) list(extra ...string) ([]pipListEntry, error) {
+	data, err := queryPkgManager([]int{0}, append([]string{m.pip, "list", "--format=json", "--disable-pip-version-check"}, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parsePipList(data)
+}
+
+func parsePipList(data string) ([]pipListEntry, error) {
+	// pip may print warnings before the json
+	if i := strings.Index(data, "["); i > 0 {
+		data = data[i:]
+	}
+	entries := []pipListEntry{}
+	if err := json.Unmarshal([]byte(data), &entries); err != nil {
+		return nil, fmt.Errorf("cannot parse pip list: %w", err)
+	}
+	return entries, nil
+}
+
+func (m pipManager) current() (map[string]pkgInstalled, error) {
+	entries, err := m.list()
+	if err != nil {
+		return nil, err
+	}
+	pkgs := map[string]pkgInstalled{}
+	for _, e := range entries {
+		pkgs[m.normalize(e.Name)] = pkgInstalled{version: e.Version}
+	}
+	return pkgs, nil
+}
+
+func (m pipManager) upgradable([]string, map[string]pkgInstalled) (map[string]bool, error) {
+	entries, err := m.list("--outdated")
+	if err != nil {
+		return nil, err
+	}
+	upgradable := map[string]bool{}
+	for _, e := range entries {
+		upgradable[m.normalize(e.Name)] = true
+	}
+	return upgradable, nil
+}
+
+func (m pipManager) apply(w pkgWork) model.TaskResult {
+	if len(w.hold)+len(w.unhold) > 0 {
+		return failure("hold is not supported for pip")
+	}
+	install := []string{}
+	for _, p := range w.install {
+		switch {
+		case p.req != "":
+			install = append(install, p.req)
+		case p.version != "":
+			install = append(install, p.name+"=="+p.version)
+		default:
+			install = append(install, p.name)
+		}
+	}
+	return m.run([]pkgStep{
+		{m.cmd("install"), install, runShell},
+		{m.cmd("install -U"), w.upgrade, runShell},
+		{m.cmd("uninstall -y"), slices.Concat(w.remove, w.purge), runShell},
+	})
+}
+
+// cmd returns a pip command, with the options from the requirements file
+func (m pipManager) cmd(sub string) string {
+	cmd := shellQuote(m.pip) + " -q --disable-pip-version-check " + sub
+	if strings.HasPrefix(sub, "install") {
+		for _, o := range m.options {
+			cmd += " " + shellQuote(o)
+		}
+	}
+	return cmd
+}
+
+// run runs the pip steps and reports changed if the installed packages
+// changed, as pip doesn't tell if requirements with markers or editables
+// were installed
+func (m pipManager) run(steps []pkgStep) model.TaskResult {
+	before, err := m.list()
+	if err != nil {
+		return failure(err)
+	}
+	tr := runSteps(steps)
+	if tr.Status == Failed {
+		return tr
+	}
+	after, err := m.list()
+	if err != nil {
+		return failure(err)
+	}
+	tr.Changed = !slices.Equal(before, after)
+	return tr
+}
@@ -0,0 +1,104 @@
+package runners
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseRequirements(t *testing.T) {
+	reqs, err := parseRequirements("# app deps\nrequests==2.31.*\n\nFlask  # web\n" +
+		"--index-url https://pypi.example.com/simple\n-e git+https://example.com/lib.git#egg=lib\n" +
+		"django>=4.2,\\\n  <5\ngunicorn state=latest\n")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"requests==2.31.*", "Flask", "django>=4.2,  <5", "gunicorn state=latest"}, reqs.specs)
+	assert.Equal(t, []string{"--index-url", "https://pypi.example.com/simple"}, reqs.options)
+	assert.Equal(t, []string{"git+https://example.com/lib.git#egg=lib"}, reqs.editable)
+
+	_, err = parseRequirements("-r other.txt\n")
+	assert.ErrorContains(t, err, "other.txt was not included")
+	_, err = parseRequirements("requests==2.31.0 --hash=sha256:abc\n")
+	assert.ErrorContains(t, err, "--hash")
+	_, err = parseRequirements("-c constraints.txt\n")
+	assert.ErrorContains(t, err, "constraints")
+}
+
+func Test_pipParseLine(t *testing.T) {
+	m := pipManager{}
+	tests := []struct {
+		line    string
+		name    string
+		version string
+		req     string
+		attrs   string
+	}{
+		{"requests==2.31.*", "requests", "2.31.*", "requests==2.31.*", ""},
+		{"requests == 2.31.0", "requests", "2.31.0", "requests == 2.31.0", ""},
+		{"requests>=2.0", "requests", "", "requests>=2.0", ""},
+		{"requests~=2.31", "requests", "", "requests~=2.31", ""},
+		{"Django!=4.0,<5", "Django", "", "Django!=4.0,<5", ""},
+		{"pkg<=1.0", "pkg", "", "pkg<=1.0", ""},
+		{"pkg===1.0", "pkg", "", "pkg===1.0", ""},
+		{"requests[socks,security]==2.31.0", "requests", "2.31.0", "requests[socks,security]==2.31.0", ""},
+		{`tomli>=2.0; python_version < "3.11"`, "tomli", "", `tomli>=2.0; python_version < "3.11"`, ""},
+		{`zope.interface==6.1; sys_platform == "linux" state=latest`, "zope.interface", "6.1", `zope.interface==6.1; sys_platform == "linux"`, "state=latest"},
+		{"lib @ https://example.com/lib-1.0.whl", "lib", "", "lib @ https://example.com/lib-1.0.whl", ""},
+		{"gunicorn state=absent", "gunicorn", "", "gunicorn", "state=absent"},
+	}
+	for _, tc := range tests {
+		p, attrs, err := m.parseLine(tc.line)
+		require.NoError(t, err, tc.line)
+		assert.Equal(t, pkgSpec{name: tc.name, version: tc.version, req: tc.req}, p, tc.line)
+		assert.Equal(t, tc.attrs, attrs, tc.line)
+	}
+
+	_, _, err := m.parseLine(">=1.0")
+	assert.Error(t, err)
+}
+
+func Test_pipBuildWork(t *testing.T) {
+	m := pipManager{}
+	wanted, err := buildWanted(model.TaskArgs{"name": []any{
+		"requests[socks]>=2.0", "flask==3.0.*", "tomli; python_version < '3.11'", "old state=absent",
+	}}, m)
+	require.NoError(t, err)
+	assert.Equal(t, installed, wanted[0].state)
+	assert.Equal(t, removed, wanted[3].state)
+
+	for i := range wanted {
+		wanted[i].name = m.normalize(wanted[i].name)
+	}
+	current := map[string]pkgInstalled{"requests": {version: "2.31.0"}, "flask": {version: "2.3.0"}, "old": {version: "1"}}
+	w := buildWork(wanted, current, nil)
+	// any installed version satisfies >=, only == pins are compared
+	assert.Equal(t, []pkgVersion{
+		{name: "flask", version: "3.0.*", req: "flask==3.0.*"},
+		{name: "tomli", req: "tomli; python_version < '3.11'"},
+	}, w.install)
+	assert.Equal(t, []string{"old"}, w.remove)
+}
+
+func Test_readRequirements(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "req"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "requirements.txt"), []byte("-r req/base.txt\nflask\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "req/base.txt"), []byte("requests>=2.0 # http\n"), 0o644))
+
+	data, err := readRequirements(filepath.Join(dir, "requirements.txt"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, "requests>=2.0\nflask", data)
+}
+
+func Test_parsePipList(t *testing.T) {
+	entries, err := parsePipList("WARNING: something\n" + `[{"name": "Flask", "version": "3.0.0"}, {"name": "zope.interface", "version": "6.1"}]`)
+	require.NoError(t, err)
+	assert.Equal(t, []pipListEntry{{Name: "Flask", Version: "3.0.0"}, {Name: "zope.interface", Version: "6.1"}}, entries)
+
+	m := pipManager{}
+	assert.Equal(t, "zope-interface", m.normalize("zope.interface"))
+	assert.Equal(t, "flask-sqlalchemy", m.normalize("Flask_SQLAlchemy"))
+}
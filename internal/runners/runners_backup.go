@@ -0,0 +1,308 @@
+package runners
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+)
+
+// Before a runner overwrites or removes a file, it stores the old version
+// under <backup root>/<run-id>/files/<path>. The manifest lists all changed
+// paths per run, so that "whip rollback" can restore them later. Only the
+// last backupKeep runs are kept.
+
+const (
+	backupManifest = "manifest.jsonl"
+	backupKeep     = 10
+)
+
+// backupRoots are tried in order and the first writable one is used, so a
+// deputy that doesn't run as root still makes backups
+var backupRoots = []string{"/var/lib/whip/backups", "~/.cache/whip/backups"}
+
+// backup is the run that is being backed up, nil if backups are disabled
+var backup *backupRun
+
+type backupRun struct {
+	dir     string
+	entries []backupEntry
+	seen    map[string]bool
+}
+
+type backupEntry struct {
+	Path    string   `json:"path"`
+	Existed bool     `json:"existed"`
+	Notify  []string `json:"notify,omitempty"`
+}
+
+func init() {
+	registerRunner("rollback", runner{
+		run:      rollback,
+		internal: true,
+		meta: RunnerMeta{
+			Desc: "Restores the files changed during a previous run, used by \"whip rollback\"",
+			Args: []Arg{{Name: "run_id", Kind: ArgString, Required: true, Desc: "such as 20240101T120000Z"}},
+		},
+	})
+}
+
+// SetRunID is called by the deputy so that subsequent file changes are
+// backed up under this run id, until FinishRun. Backups are disabled for an
+// empty id, or if no backup root is writable.
+func SetRunID(id string) {
+	backup = nil
+	if id == "" {
+		return
+	}
+	root := writableBackupRoot()
+	if root == "" {
+		log.Warn("No writable backup dir in", strings.Join(backupRoots, " or "), "so changed files are not backed up")
+		return
+	}
+	if err := pruneBackups(root, backupKeep-1); err != nil {
+		log.Warn("Cannot prune old backups:", err)
+	}
+	backup = &backupRun{dir: filepath.Join(root, id), seen: map[string]bool{}}
+}
+
+// FinishRun writes the backup manifest of the run, so it can be rolled back
+func FinishRun() error {
+	b := backup
+	backup = nil
+	if b == nil || len(b.entries) == 0 {
+		return nil
+	}
+	lines := ""
+	for _, e := range b.entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		lines += string(line) + "\n"
+	}
+	if err := fs.MkdirAll(b.dir, 0o700); err != nil {
+		return err
+	}
+	return fsutil.WriteFile(filepath.Join(b.dir, backupManifest), []byte(lines), 0o600)
+}
+
+func writableBackupRoot() string {
+	for _, root := range backupRoots {
+		root = expandHome(root)
+		if root == "" {
+			continue
+		}
+		if err := fs.MkdirAll(root, 0o700); err != nil {
+			continue
+		}
+		probe, err := fsutil.TempFile(root, ".probe_*")
+		if err != nil {
+			continue
+		}
+		_ = probe.Close()
+		_ = fs.Remove(probe.Name())
+		return root
+	}
+	return ""
+}
+
+// expandHome replaces a leading ~/ with the home dir, or returns "" if
+// there is no home dir
+func expandHome(path string) string {
+	rest, ok := strings.CutPrefix(path, "~/")
+	if !ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, rest)
+}
+
+// pruneBackups removes all but the last keep runs. Run ids are timestamps,
+// so they sort by age.
+func pruneBackups(root string, keep int) error {
+	infos, err := fsutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	runs := []string{}
+	for _, fi := range infos {
+		if fi.IsDir() {
+			runs = append(runs, fi.Name())
+		}
+	}
+	slices.Sort(runs)
+	for _, run := range runs[:max(len(runs)-keep, 0)] {
+		if err := fs.RemoveAll(filepath.Join(root, run)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findBackupDir returns the dir with the backups of run id, in any of the
+// backup roots
+func findBackupDir(id string) (string, error) {
+	for _, root := range backupRoots {
+		root = expandHome(root)
+		if root == "" {
+			continue
+		}
+		dir := filepath.Join(root, id)
+		if ok, _ := fsutil.Exists(filepath.Join(dir, backupManifest)); ok {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("no backups found for run %s", id)
+}
+
+// backupFile saves the current version of path (if any) before it is
+// replaced or removed. Only the first change per run is recorded, so
+// a rollback restores the state from before the run.
+func backupFile(path string, notify []string) error {
+	if backup == nil || backup.seen[path] {
+		return nil
+	}
+
+	entry := backupEntry{Path: path, Notify: notify}
+
+	fi, err := fs.Stat(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if fi != nil && fi.IsDir() {
+		return fmt.Errorf("cannot backup dir %s", path)
+	}
+
+	if fi != nil {
+		entry.Existed = true
+		if err := copyFile(path, filepath.Join(backup.dir, "files", path)); err != nil {
+			return fmt.Errorf("backup of %s: %w", path, err)
+		}
+	}
+	backup.seen[path] = true
+	backup.entries = append(backup.entries, entry)
+	return nil
+}
+
+func readManifest(dir string) ([]backupEntry, error) {
+	data, err := fsutil.ReadFile(filepath.Join(dir, backupManifest))
+	if err != nil {
+		return nil, err
+	}
+	entries := []backupEntry{}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if line == "" {
+			continue
+		}
+		var e backupEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("corrupt backup manifest in %s: %w", dir, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// copyFile copies src to dst, including mode and ownership. The copy is
+// written to a temp file first, so dst is replaced atomically.
+func copyFile(src, dst string) error {
+	fi, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+	in, err := fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := fs.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		return err
+	}
+	tmp, err := fsutil.TempFile(filepath.Dir(dst), "temp_*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		_ = tmp.Close()
+		_ = fs.Remove(tmpPath)
+	}()
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := fs.Chmod(tmpPath, fi.Mode()); err != nil {
+		return err
+	}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if err := fs.Chown(tmpPath, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	return fs.Rename(tmpPath, dst)
+}
+
+// rollback restores all files that were changed during run_id, in reverse
+// order. Files that did not exist before the run are removed. Handlers that
+// were notified for the changed files are notified again.
+func rollback(t *model.Task) (tr model.TaskResult) {
+	id := t.Args.String("run_id")
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return failure("invalid run_id", id)
+	}
+
+	dir, err := findBackupDir(id)
+	if err != nil {
+		return failure(err)
+	}
+	entries, err := readManifest(dir)
+	if err != nil {
+		return failure("cannot read backups for run", id, err)
+	}
+
+	tr.Notify = map[string]bool{}
+	output := ""
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if err := backupFile(e.Path, e.Notify); err != nil {
+			return failure(err)
+		}
+		status := "restore"
+		if e.Existed {
+			err = copyFile(filepath.Join(dir, "files", e.Path), e.Path)
+		} else {
+			status = "remove"
+			err = fs.Remove(e.Path)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return failure("cannot rollback", e.Path, err)
+		}
+		for _, n := range e.Notify {
+			tr.Notify[n] = true
+		}
+		output += fmt.Sprintf("%-7s %s\n", status, e.Path)
+	}
+
+	tr.Changed = len(entries) > 0
+	tr.Output = output
+	tr.Status = Success
+	return tr
+}
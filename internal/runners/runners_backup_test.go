@@ -0,0 +1,85 @@
+package runners
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/model"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_backupAndRollback(t *testing.T) {
+	log.SetLevel(log.LevelError)
+	defer log.SetLevel(log.LevelDebug)
+
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+		SetRunID("")
+	}()
+	createTestFS()
+
+	require.NoError(t, fs.MkdirAll("/etc/nginx", 0o755))
+	require.NoError(t, fsutil.WriteFile("/etc/nginx/nginx.conf", []byte("old"), 0o644))
+
+	SetRunID("run1")
+	for _, f := range []filesObj{
+		{path: "/etc/nginx/nginx.conf", data: []byte("new"), mode: 0o644, notify: []string{"nginx"}},
+		{path: "/etc/nginx/extra.conf", data: []byte("extra"), mode: 0o644},
+	} {
+		changed, err := ensureFile(f)
+		require.NoError(t, err)
+		require.True(t, changed)
+	}
+
+	require.NoError(t, FinishRun())
+
+	SetRunID("run2")
+	tr := rollback(&model.Task{Args: model.TaskArgs{"run_id": "run1"}})
+	require.Equal(t, Success, tr.Status, tr.Output)
+	require.True(t, tr.Changed)
+	require.Equal(t, map[string]bool{"nginx": true}, tr.Notify)
+
+	data, err := fsutil.ReadFile("/etc/nginx/nginx.conf")
+	require.NoError(t, err)
+	require.Equal(t, "old", string(data))
+
+	ok, err := fsutil.Exists("/etc/nginx/extra.conf")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	tr = rollback(&model.Task{Args: model.TaskArgs{"run_id": "../run1"}})
+	require.Equal(t, Failed, tr.Status)
+}
+
+func Test_backupRootsAndPrune(t *testing.T) {
+	oldFs, oldFsutil, oldRoots := fs, fsutil, backupRoots
+	defer func() {
+		fs, fsutil, backupRoots = oldFs, oldFsutil, oldRoots
+		SetRunID("")
+	}()
+	createTestFS()
+
+	// an unwritable root is skipped
+	fs = afero.NewReadOnlyFs(afero.NewMemMapFs())
+	fsutil = &afero.Afero{Fs: fs}
+	SetRunID("run0")
+	require.Nil(t, backup)
+
+	createTestFS()
+	backupRoots = []string{"/backups"}
+	for i := range backupKeep + 2 {
+		SetRunID(fmt.Sprintf("run%02d", i))
+		require.NoError(t, fsutil.WriteFile(fmt.Sprintf("/file%d", i), []byte("old"), 0o644))
+		require.NoError(t, backupFile(fmt.Sprintf("/file%d", i), nil))
+		require.NoError(t, FinishRun())
+	}
+	infos, err := fsutil.ReadDir("/backups")
+	require.NoError(t, err)
+	require.Len(t, infos, backupKeep)
+	require.Equal(t, "run02", infos[0].Name())
+}
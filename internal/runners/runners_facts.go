@@ -4,12 +4,35 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 )
 
+const osReleaseFile = "/etc/os-release"
+
 func gatherFacts() map[string]string {
 	facts := map[string]string{}
 	facts["hostname"], _ = os.Hostname()
 	facts["user"] = os.Getenv("USER")
 	facts["num_cpu"] = fmt.Sprint(runtime.NumCPU())
+
+	if data, err := os.ReadFile(osReleaseFile); err == nil {
+		osRelease := parseOSRelease(string(data))
+		facts["os_id"] = osRelease["ID"]
+		facts["os_id_like"] = osRelease["ID_LIKE"]
+		facts["os_codename"] = osRelease["VERSION_CODENAME"]
+	}
 	return facts
 }
+
+// parseOSRelease parses the KEY=value lines of /etc/os-release
+func parseOSRelease(data string) map[string]string {
+	kv := map[string]string{}
+	for _, line := range strings.Split(data, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		kv[k] = strings.Trim(v, `"'`)
+	}
+	return kv
+}
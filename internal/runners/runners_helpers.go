@@ -154,6 +154,11 @@ func execCommand(cmd []string) ([]byte, error) {
 	return exec.Command(cmd[0], args...).CombinedOutput()
 }
 
+// shellQuote quotes s for use as a single /bin/sh argument
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 func isText(s []byte) bool {
 	const max = 1024 // at least utf8.UTFMax
 	if len(s) > max {
@@ -0,0 +1,203 @@
+package runners
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/parser"
+)
+
+// ArgKind is the type of a runner arg
+type ArgKind string
+
+const (
+	ArgString ArgKind = "string"
+	ArgBool   ArgKind = "bool"
+	ArgInt    ArgKind = "int"
+	ArgList   ArgKind = "list" // a list of strings, or a single string
+	ArgMap    ArgKind = "map"
+)
+
+type (
+	// Arg describes an argument of a runner
+	Arg struct {
+		Name     string
+		Kind     ArgKind
+		Required bool
+		Enum     []string
+		Default  string
+		Desc     string
+	}
+
+	// RunnerMeta describes a runner and its args, so tasks can be linted on
+	// the controller before they are sent, and for "whip doc" and "whip schema"
+	RunnerMeta struct {
+		Desc      string
+		Args      []Arg
+		Exclusive [][]string // args that cannot be combined
+		Extra     string     // describes other args the runner takes, if any
+		Examples  []string   // yaml task lists, parsed by the playbook tests
+
+		// PrefixAttrs are the key=value attributes of path prefix args, such
+		// as /etc/nginx: owner=root mode=0644, for runners that take them
+		PrefixAttrs []string
+	}
+)
+
+// BoolStrings are the strings that a bool arg accepts
+var BoolStrings = []string{"yes", "no", "true", "false", "on", "off", "1", "0"}
+
+// Meta returns the metadata of a runner
+func Meta(name string) (RunnerMeta, bool) {
+	r, ok := publicRunner(name)
+	return r.meta, ok
+}
+
+// FreeForm reports whether a runner only takes a free-form string, such as
+// shell, so its string value should not be split into key=value args
+func FreeForm(name string) bool {
+	args := runners[name].meta.Args
+	return len(args) == 1 && args[0].Name == parser.DefaultArg
+}
+
+func (m RunnerMeta) arg(name string) (Arg, bool) {
+	i := slices.IndexFunc(m.Args, func(a Arg) bool { return a.Name == name })
+	if i < 0 {
+		return Arg{}, false
+	}
+	return m.Args[i], true
+}
+
+// checkArgs returns an error if any of the required args is missing
+func (m RunnerMeta) checkArgs(args model.TaskArgs) error {
+	missing := []string{}
+	for _, a := range m.Args {
+		if !a.Required {
+			continue
+		}
+		if v, ok := args[a.Name]; !ok || v == nil || v == "" {
+			missing = append(missing, a.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required args: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckTask lints the args of a task against the metadata of its runner
+// and returns all problems
+func CheckTask(t model.Task) error {
+	r, ok := publicRunner(t.Runner)
+	if !ok {
+		return fmt.Errorf("unknown runner %q%s", t.Runner, parser.Suggest(t.Runner, All()))
+	}
+	m := r.meta
+
+	errs := []error{}
+	if err := m.checkArgs(t.Args); err != nil {
+		errs = append(errs, err)
+	}
+
+	names := []string{}
+	for name := range t.Args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	known := []string{}
+	for _, a := range m.Args {
+		known = append(known, a.Name)
+	}
+
+	for _, name := range names {
+		v := t.Args[name]
+		a, ok := m.arg(name)
+		switch {
+		case ok:
+			if err := a.check(v); err != nil {
+				errs = append(errs, err)
+			}
+		case name == parser.DefaultArg:
+			if s, _ := v.(string); s != "" {
+				errs = append(errs, fmt.Errorf("%s takes no free-form args, use key=value instead of %q", t.Runner, s))
+			}
+		case m.Extra != "":
+			// checked by the runner's validator
+		default:
+			errs = append(errs, fmt.Errorf("unknown arg %q%s", name, parser.Suggest(name, known)))
+		}
+	}
+
+	for _, group := range m.Exclusive {
+		present := []string{}
+		for _, name := range group {
+			if t.Args[name] != nil {
+				present = append(present, name)
+			}
+		}
+		if len(present) > 1 {
+			errs = append(errs, fmt.Errorf("args %s cannot be combined", strings.Join(present, " and ")))
+		}
+	}
+
+	if r.validate != nil {
+		if err := r.validate(t.Args); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// check returns an error if v doesn't match the kind or enum of the arg.
+// Templated values are only known at the target, so they always pass.
+func (a Arg) check(v any) error {
+	if s, ok := v.(string); ok && strings.Contains(s, "{{") {
+		return nil
+	}
+	ok := false
+	switch a.Kind {
+	case ArgString:
+		_, ok = v.(string)
+	case ArgBool:
+		switch v := v.(type) {
+		case bool:
+			ok = true
+		case int:
+			ok = v == 0 || v == 1
+		case string:
+			ok = slices.Contains(BoolStrings, strings.ToLower(v))
+		}
+	case ArgInt:
+		switch v := v.(type) {
+		case int:
+			ok = true
+		case string:
+			_, err := strconv.Atoi(v)
+			ok = err == nil
+		}
+	case ArgList:
+		switch v := v.(type) {
+		case string:
+			ok = true
+		case []any:
+			ok = !slices.ContainsFunc(v, func(e any) bool { _, isString := e.(string); return !isString })
+		}
+	case ArgMap:
+		_, ok = v.(map[string]any)
+	default:
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("arg %s should be a %s, not %v", a.Name, a.Kind, v)
+	}
+	if s, isString := v.(string); isString && len(a.Enum) > 0 && !slices.Contains(a.Enum, s) {
+		return fmt.Errorf("arg %s should be one of %s, not %q%s", a.Name, strings.Join(a.Enum, "|"), s, parser.Suggest(s, a.Enum))
+	}
+	return nil
+}
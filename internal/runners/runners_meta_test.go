@@ -0,0 +1,71 @@
+package runners
+
+import (
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ArgCheck(t *testing.T) {
+	tests := []struct {
+		arg Arg
+		v   any
+		ok  bool
+	}{
+		{Arg{Name: "a", Kind: ArgString}, "x", true},
+		{Arg{Name: "a", Kind: ArgString}, 1, false},
+		{Arg{Name: "a", Kind: ArgBool}, "yes", true},
+		{Arg{Name: "a", Kind: ArgBool}, true, true},
+		{Arg{Name: "a", Kind: ArgBool}, "maybe", false},
+		{Arg{Name: "a", Kind: ArgInt}, "60", true},
+		{Arg{Name: "a", Kind: ArgInt}, 60, true},
+		{Arg{Name: "a", Kind: ArgInt}, "soon", false},
+		{Arg{Name: "a", Kind: ArgList}, "x", true},
+		{Arg{Name: "a", Kind: ArgList}, []any{"x", "y"}, true},
+		{Arg{Name: "a", Kind: ArgList}, []any{"x", 1}, false},
+		{Arg{Name: "a", Kind: ArgMap}, map[string]any{}, true},
+		{Arg{Name: "a", Kind: ArgMap}, "x", false},
+		{Arg{Name: "a", Kind: ArgString, Enum: []string{"on", "off"}}, "on", true},
+		{Arg{Name: "a", Kind: ArgString, Enum: []string{"on", "off"}}, "of", false},
+		{Arg{Name: "a", Kind: ArgBool}, "{{ enabled }}", true},
+	}
+	for _, tc := range tests {
+		err := tc.arg.check(tc.v)
+		assert.Equal(t, tc.ok, err == nil, "%s %v: %v", tc.arg.Kind, tc.v, err)
+	}
+}
+
+func Test_CheckTask(t *testing.T) {
+	require.NoError(t, CheckTask(model.Task{Runner: "service", Args: model.TaskArgs{"name": "nginx", "state": "started", "_args": ""}}))
+
+	err := CheckTask(model.Task{Runner: "service", Args: model.TaskArgs{"state": "started", "enable": true}})
+	require.Error(t, err)
+	assert.Equal(t, "missing required args: name\nunknown arg \"enable\", did you mean \"enabled\"?", err.Error())
+
+	err = CheckTask(model.Task{Runner: "servic"})
+	assert.EqualError(t, err, `unknown runner "servic", did you mean "service"?`)
+}
+
+func Test_internalRunners(t *testing.T) {
+	// rollback is run by "whip rollback", but cannot be used in playbooks
+	assert.NotContains(t, All(), "rollback")
+	_, ok := Meta("rollback")
+	assert.False(t, ok)
+	assert.ErrorContains(t, CheckTask(model.Task{Runner: "rollback", Args: model.TaskArgs{"run_id": "20240101T120000Z"}}), `unknown runner "rollback"`)
+
+	tr := Run(&model.Task{Runner: "rollback", Args: model.TaskArgs{"run_id": "../x"}}, nil)
+	assert.Equal(t, Failed, tr.Status)
+	assert.Contains(t, tr.Output, "invalid run_id")
+}
+
+func Test_AllRunnersHaveArgs(t *testing.T) {
+	for _, name := range All() {
+		if name == "dummy" {
+			continue // test runner
+		}
+		m, _ := Meta(name)
+		assert.NotEmpty(t, m.Args, name)
+	}
+}
@@ -2,6 +2,7 @@ package runners
 
 import (
 	"fmt"
+	"maps"
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
@@ -28,16 +29,15 @@ type (
 	validatorFunc func(model.TaskArgs) error
 	preRunnerFunc func(*model.Task) model.TaskResult
 
-	runnerMeta struct {
-		requiredArgs []string
-		optionalArgs []string
-	}
-
 	runner struct {
 		run      runnerFunc
-		meta     runnerMeta
+		meta     RunnerMeta
 		prerun   runnerFunc
 		validate validatorFunc
+
+		// internal runners are only used by whip itself, such as rollback,
+		// so they are left out of playbooks, "whip doc" and "whip schema"
+		internal bool
 	}
 )
 
@@ -56,10 +56,13 @@ func init() {
 	}
 }
 
+// All returns the names of the runners that can be used in playbooks
 func All() []string {
 	keys := []string{}
-	for k := range runners {
-		keys = append(keys, k)
+	for k, r := range runners {
+		if !r.internal {
+			keys = append(keys, k)
+		}
 	}
 	sort.StringSlice(keys).Sort()
 	return keys
@@ -92,6 +95,12 @@ func registerRunner(name string, r runner) {
 	runners[name] = r
 }
 
+// publicRunner returns the runner of name, if it can be used in playbooks
+func publicRunner(name string) (runner, bool) {
+	r, ok := runners[name]
+	return r, ok && !r.internal
+}
+
 func PreRun(task *model.Task, playVars model.TaskVars) (tr model.TaskResult) {
 	runner, ok := runners[task.Runner]
 	if !ok {
@@ -153,6 +162,10 @@ func Run(task *model.Task, playVars model.TaskVars) (tr model.TaskResult) {
 		}
 	}
 
+	if e := runner.meta.checkArgs(task.Args); e != nil {
+		return fail(e.Error())
+	}
+
 	if e := mergo.Merge(&task.Vars, playVars); e != nil {
 		return fail(e.Error())
 	}
@@ -173,3 +186,21 @@ func Run(task *model.Task, playVars model.TaskVars) (tr model.TaskResult) {
 	tr.Task = task
 	return tr
 }
+
+// EvalWhen evaluates the when condition of a task with the task and play
+// vars, an empty condition is true
+func EvalWhen(task *model.Task, playVars model.TaskVars) (bool, error) {
+	if task.When == "" {
+		return true, nil
+	}
+	vars := maps.Clone(playVars)
+	if vars == nil {
+		vars = model.TaskVars{}
+	}
+	maps.Copy(vars, task.Vars)
+	out, err := tplParseString("{% if "+task.When+" %}true{% endif %}", vars)
+	if err != nil {
+		return false, fmt.Errorf("when %q: %w", task.When, err)
+	}
+	return out == "true", nil
+}
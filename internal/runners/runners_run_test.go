@@ -28,3 +28,32 @@ func Test_PreRun(t *testing.T) {
 	require.Equal(t, tr.Status, Skipped)
 	require.Equal(t, new, task.Vars["key"])
 }
+
+func Test_checkArgs(t *testing.T) {
+	meta := RunnerMeta{Args: []Arg{{Name: "name", Required: true}, {Name: "state", Required: true}, {Name: "enabled"}}}
+	require.NoError(t, meta.checkArgs(model.TaskArgs{"name": "nginx", "state": "started"}))
+	require.EqualError(t, meta.checkArgs(model.TaskArgs{"name": ""}), "missing required args: name, state")
+}
+
+func Test_EvalWhen(t *testing.T) {
+	playVars := model.TaskVars{"env": "prod", "debug": false}
+	tests := []struct {
+		when string
+		vars model.TaskVars
+		want bool
+	}{
+		{"", nil, true},
+		{"env == 'prod'", nil, true},
+		{"env == 'prod'", model.TaskVars{"env": "test"}, false},
+		{"(env == 'prod') and (not debug)", nil, true},
+		{"debug", nil, false},
+	}
+	for _, tc := range tests {
+		ok, err := EvalWhen(&model.Task{When: tc.when, Vars: tc.vars}, playVars)
+		require.NoError(t, err, tc.when)
+		require.Equal(t, tc.want, ok, tc.when)
+	}
+
+	_, err := EvalWhen(&model.Task{When: "env =="}, playVars)
+	require.Error(t, err)
+}
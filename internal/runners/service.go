@@ -2,10 +2,14 @@ package runners
 
 import (
 	"fmt"
+	"os/exec"
+	"slices"
+	"strings"
 
 	"github.com/gwillem/whip/internal/model"
 )
 
+// ServiceStateMap maps the wanted state to a systemctl command
 var ServiceStateMap = map[string]string{
 	"started":   "start",
 	"stopped":   "stop",
@@ -13,21 +17,169 @@ var ServiceStateMap = map[string]string{
 	"reloaded":  "reload",
 }
 
+var (
+	activeStates  = []string{"active", "activating", "reloading"}
+	enabledStates = []string{"enabled", "enabled-runtime", "linked", "linked-runtime", "alias"}
+)
+
+// systemctl runs systemctl with args. A var, so it can be stubbed in tests.
+var systemctl = func(args ...string) ([]byte, error) {
+	return exec.Command("systemctl", args...).CombinedOutput()
+}
+
+// unitState is the relevant part of "systemctl show"
+type unitState struct {
+	LoadState     string
+	ActiveState   string
+	UnitFileState string
+}
+
+func getUnitState(name string) (unitState, error) {
+	data, err := systemctl("show", "--property=LoadState,ActiveState,UnitFileState", "--", name)
+	if err != nil {
+		return unitState{}, fmt.Errorf("systemctl show %s: %w\n%s", name, err, data)
+	}
+	return parseUnitState(string(data)), nil
+}
+
+// parseUnitState parses the Key=Value lines of "systemctl show"
+func parseUnitState(data string) (us unitState) {
+	for _, line := range strings.Split(data, "\n") {
+		k, v, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch k {
+		case "LoadState":
+			us.LoadState = v
+		case "ActiveState":
+			us.ActiveState = v
+		case "UnitFileState":
+			us.UnitFileState = v
+		}
+	}
+	return us
+}
+
+// serviceCmds returns the systemctl commands to get unit from its current
+// state us to the wanted state in args. The order matters: a masked unit
+// cannot be enabled or started.
+func serviceCmds(args model.TaskArgs, us unitState) (cmds []string) {
+	masked := us.UnitFileState == "masked"
+	if args["masked"] != nil {
+		switch want := args.Bool("masked"); {
+		case want && !masked:
+			// stop first, as mask doesn't stop a running unit
+			if slices.Contains(activeStates, us.ActiveState) {
+				cmds = append(cmds, "stop")
+			}
+			return append(cmds, "mask")
+		case want:
+			return nil
+		case masked:
+			cmds = append(cmds, "unmask")
+			us.UnitFileState = "disabled"
+		}
+	}
+
+	if args["enabled"] != nil {
+		enabled := slices.Contains(enabledStates, us.UnitFileState)
+		switch want := args.Bool("enabled"); {
+		case want && !enabled && us.UnitFileState != "static":
+			cmds = append(cmds, "enable")
+		case !want && enabled:
+			cmds = append(cmds, "disable")
+		}
+	}
+
+	active := slices.Contains(activeStates, us.ActiveState)
+	switch args.String("state") {
+	case "started":
+		if !active {
+			cmds = append(cmds, "start")
+		}
+	case "stopped":
+		if active {
+			cmds = append(cmds, "stop")
+		}
+	case "restarted":
+		cmds = append(cmds, "restart")
+	case "reloaded":
+		// a stopped service is started instead, like Ansible does
+		if active {
+			cmds = append(cmds, "reload")
+		} else {
+			cmds = append(cmds, "start")
+		}
+	}
+	return cmds
+}
+
 func Service(t *model.Task) (tr model.TaskResult) {
-	state := ServiceStateMap[t.Args.String("state")]
-	if state == "" {
+	if s := t.Args.String("state"); s != "" && ServiceStateMap[s] == "" {
 		return failure("unknown state, try started|stopped|restarted|reloaded")
 	}
-	cmd := []string{"/bin/bash", "-c", fmt.Sprintf("systemctl %s %s", state, t.Args.String("name"))}
-	return system(cmd)
+
+	tr.Status = Success
+
+	if t.Args.Bool("daemon_reload") {
+		// picking up changed unit files is not a change by itself
+		if data, err := systemctl("daemon-reload"); err != nil {
+			return failure("systemctl daemon-reload:", err, string(data))
+		}
+	}
+
+	for _, name := range t.Args.StringSlice("name") {
+		res := ensureUnit(name, t.Args)
+		tr.Output += res.Output
+		tr.Changed = tr.Changed || res.Changed
+		if res.Status == Failed {
+			tr.Status = Failed
+			return tr
+		}
+	}
+	return tr
+}
+
+// ensureUnit brings a unit to the state, enabled and masked args
+func ensureUnit(name string, args model.TaskArgs) (tr model.TaskResult) {
+	us, err := getUnitState(name)
+	if err != nil {
+		return failure(err)
+	}
+	if us.LoadState == "not-found" {
+		return failure("unit not found:", name)
+	}
+
+	tr.Status = Success
+	for _, cmd := range serviceCmds(args, us) {
+		data, err := systemctl(cmd, "--", name)
+		tr.Output += fmt.Sprintf("%s %s\n%s", cmd, name, data)
+		if err != nil {
+			tr.Status = Failed
+			tr.Output += err.Error()
+			return tr
+		}
+		tr.Changed = true
+	}
+	return tr
 }
 
 func init() {
 	registerRunner("service", runner{
 		run: Service,
-		meta: runnerMeta{
-			requiredArgs: []string{"name", "state"},
-			optionalArgs: []string{},
+		meta: RunnerMeta{
+			Desc: "Brings systemd units to a state, only running systemctl when needed",
+			Args: []Arg{
+				{Name: "name", Kind: ArgList, Required: true, Desc: "one or more units"},
+				{Name: "state", Kind: ArgString, Enum: []string{"started", "stopped", "restarted", "reloaded"}, Desc: "reloaded starts a stopped unit"},
+				{Name: "enabled", Kind: ArgBool, Desc: "start at boot"},
+				{Name: "masked", Kind: ArgBool},
+				{Name: "daemon_reload", Kind: ArgBool, Default: "no", Desc: "reload unit files first"},
+			},
+			Examples: []string{`
+- service:
+    name: nginx, php8.3-fpm
+    state: started
+    enabled: yes
+`},
 		},
 	})
 }
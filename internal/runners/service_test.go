@@ -0,0 +1,72 @@
+package runners
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseUnitState(t *testing.T) {
+	us := parseUnitState("LoadState=loaded\nActiveState=active\nUnitFileState=enabled\n")
+	assert.Equal(t, unitState{LoadState: "loaded", ActiveState: "active", UnitFileState: "enabled"}, us)
+}
+
+func Test_serviceCmds(t *testing.T) {
+	running := unitState{LoadState: "loaded", ActiveState: "active", UnitFileState: "enabled"}
+	stopped := unitState{LoadState: "loaded", ActiveState: "inactive", UnitFileState: "disabled"}
+	masked := unitState{LoadState: "masked", ActiveState: "inactive", UnitFileState: "masked"}
+
+	tests := []struct {
+		args model.TaskArgs
+		us   unitState
+		want []string
+	}{
+		{model.TaskArgs{"state": "started", "enabled": "yes"}, running, nil},
+		{model.TaskArgs{"state": "started", "enabled": "yes"}, stopped, []string{"enable", "start"}},
+		{model.TaskArgs{"state": "stopped", "enabled": false}, running, []string{"disable", "stop"}},
+		{model.TaskArgs{"state": "stopped"}, stopped, nil},
+		{model.TaskArgs{"state": "restarted"}, running, []string{"restart"}},
+		{model.TaskArgs{"state": "reloaded"}, running, []string{"reload"}},
+		{model.TaskArgs{"state": "reloaded"}, stopped, []string{"start"}},
+		{model.TaskArgs{"masked": "yes"}, running, []string{"stop", "mask"}},
+		{model.TaskArgs{"masked": "yes", "state": "started"}, masked, nil},
+		{model.TaskArgs{"masked": "no", "state": "started"}, masked, []string{"unmask", "start"}},
+		{model.TaskArgs{"enabled": "yes"}, unitState{UnitFileState: "static"}, nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, serviceCmds(tt.args, tt.us), tt.args)
+	}
+}
+
+func Test_Service(t *testing.T) {
+	oldSystemctl := systemctl
+	defer func() { systemctl = oldSystemctl }()
+
+	calls := []string{}
+	states := map[string]string{
+		"nginx": "LoadState=loaded\nActiveState=active\nUnitFileState=enabled\n",
+		"php":   "LoadState=loaded\nActiveState=failed\nUnitFileState=enabled\n",
+	}
+	systemctl = func(args ...string) ([]byte, error) {
+		if args[0] == "show" {
+			return []byte(states[args[len(args)-1]]), nil
+		}
+		calls = append(calls, strings.Join(args, " "))
+		return nil, nil
+	}
+
+	tr := Service(&model.Task{Args: model.TaskArgs{"name": []any{"nginx", "php"}, "state": "started", "daemon_reload": "yes"}})
+	assert.Equal(t, Success, tr.Status)
+	assert.True(t, tr.Changed)
+	assert.Equal(t, []string{"daemon-reload", "start -- php"}, calls)
+
+	calls = nil
+	tr = Service(&model.Task{Args: model.TaskArgs{"name": "nginx", "state": "started"}})
+	assert.False(t, tr.Changed)
+	assert.Empty(t, calls)
+
+	tr = Service(&model.Task{Args: model.TaskArgs{"name": "nginx", "state": "running"}})
+	assert.Equal(t, Failed, tr.Status)
+}
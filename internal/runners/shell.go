@@ -11,7 +11,17 @@ func shell(t *model.Task) (tr model.TaskResult) {
 }
 
 func init() {
-	registerRunner("shell", runner{run: shell})
+	registerRunner("shell", runner{
+		run: shell,
+		meta: RunnerMeta{
+			Desc: "Runs a command with /bin/sh. Always reports changed, use unless to make it idempotent.",
+			Args: []Arg{{Name: parser.DefaultArg, Kind: ArgString, Required: true, Desc: "the shell command, such as: shell: echo hi > /tmp/hi"}},
+			Examples: []string{`
+- shell: locale-gen en_US.UTF-8
+  unless: locale -a | grep -q en_US.utf8
+`},
+		},
+	})
 }
 
 func runShell(cmd string) (tr model.TaskResult) {
@@ -0,0 +1,258 @@
+package runners
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/gwillem/whip/internal/vault"
+)
+
+/*
+
+systemd_unit writes a unit file (or a drop-in for it), reloads systemd if it
+changed and optionally brings the unit to a state, like the service runner.
+
+	- systemd_unit:
+	    name: backup.timer
+	    enabled: yes
+	    state: started
+	    unit:
+	      Unit:
+	        Description: Nightly backup
+	      Timer:
+	        OnCalendar: daily
+	        Persistent: true
+	      Install:
+	        WantedBy: timers.target
+
+Instead of inline sections, a template on the controller can be given with
+"template". With "dropin: 10-limits.conf", the file is written to
+/etc/systemd/system/<name>.d/ instead. List values become repeated keys, so
+ExecStart: ["", "/usr/bin/foo"] resets and overrides ExecStart.
+
+*/
+
+const systemdUnitDir = "/etc/systemd/system"
+
+var systemdUnitName = regexp.MustCompile(`^[a-zA-Z0-9:_.@\\-]+$`)
+
+func init() {
+	registerRunner("systemd_unit", runner{
+		run:    systemdUnit,
+		prerun: systemdUnitPrerun,
+		meta: RunnerMeta{
+			Desc: "Writes a systemd unit file or drop-in, reloads systemd if it changed and brings the unit to a state",
+			Args: []Arg{
+				{Name: "name", Kind: ArgString, Required: true, Desc: "unit name, such as backup.timer"},
+				{Name: "unit", Kind: ArgMap, Desc: "sections with keys, lists become repeated keys"},
+				{Name: "template", Kind: ArgString, Desc: "unit file template on the controller"},
+				{Name: "dropin", Kind: ArgString, Desc: "write /etc/systemd/system/<name>.d/<dropin> instead, such as 10-limits.conf"},
+				{Name: "state", Kind: ArgString, Enum: []string{"started", "stopped", "restarted", "reloaded", "absent"}, Desc: "absent removes the unit file"},
+				{Name: "enabled", Kind: ArgBool},
+				{Name: "masked", Kind: ArgBool},
+			},
+			Exclusive: [][]string{{"unit", "template"}},
+			Examples: []string{`
+- systemd_unit:
+    name: backup.timer
+    enabled: yes
+    state: started
+    unit:
+      Unit:
+        Description: Nightly backup
+      Timer:
+        OnCalendar: daily
+        Persistent: true
+      Install:
+        WantedBy: timers.target
+`},
+		},
+	})
+}
+
+// systemdUnitPrerun reads the template on the controller into _template,
+// which is rendered with the task vars at the target, like any string arg
+func systemdUnitPrerun(t *model.Task) (tr model.TaskResult) {
+	path := t.Args.String("template")
+	if path == "" {
+		return model.TaskResult{Status: Skipped}
+	}
+	fh, err := vault.Open(path)
+	if err != nil {
+		return failure("cannot read template", path, err)
+	}
+	defer fh.Close()
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return failure("cannot read template", path, err)
+	}
+	t.Args["_template"] = string(data)
+	return model.TaskResult{Status: Success}
+}
+
+// unitPath returns the path of the unit file or drop-in
+func unitPath(name, dropin string) (string, error) {
+	if !systemdUnitName.MatchString(name) || !strings.Contains(name, ".") {
+		return "", fmt.Errorf("invalid unit name %q, should be like foo.service", name)
+	}
+	if dropin == "" {
+		return filepath.Join(systemdUnitDir, name), nil
+	}
+	if strings.Contains(dropin, "/") || !strings.HasSuffix(dropin, ".conf") {
+		return "", fmt.Errorf("invalid drop-in %q, should be like 10-override.conf", dropin)
+	}
+	return filepath.Join(systemdUnitDir, name+".d", dropin), nil
+}
+
+func systemdUnit(t *model.Task) (tr model.TaskResult) {
+	name := t.Args.String("name")
+	dropin := t.Args.String("dropin")
+	path, err := unitPath(name, dropin)
+	if err != nil {
+		return failure(err)
+	}
+
+	tr.Status = Success
+
+	if t.Args.String("state") == "absent" {
+		// stop and disable a unit before its file is gone
+		if dropin == "" {
+			if us, err := getUnitState(name); err == nil && us.LoadState == "loaded" {
+				if data, err := systemctl("disable", "--now", "--", name); err != nil {
+					return failure("systemctl disable --now", name, err, string(data))
+				}
+			}
+		}
+		if tr.Changed, err = removeFile(path, t.Notify); err != nil {
+			return failure(err)
+		}
+		if tr.Changed {
+			tr.Output = "removed " + path + "\n"
+			if data, err := systemctl("daemon-reload"); err != nil {
+				return failure("systemctl daemon-reload:", err, string(data))
+			}
+		}
+		return tr
+	}
+
+	var content string
+	switch {
+	case t.Args["_template"] != nil:
+		content = t.Args.String("_template")
+	case t.Args.String("template") != "":
+		return failure("template was not loaded:", t.Args.String("template"))
+	case t.Args["unit"] != nil:
+		sections, ok := t.Args["unit"].(map[string]any)
+		if !ok {
+			return failure("unit should be a map of sections")
+		}
+		if content, err = renderUnit(sections, t.Vars); err != nil {
+			return failure(err)
+		}
+	}
+
+	if content != "" {
+		if err := fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return failure(err)
+		}
+		f := filesObj{path: path, data: []byte(content), mode: 0o644, notify: t.Notify}
+		if tr.Changed, err = ensureFile(f); err != nil {
+			return failure(err)
+		}
+		if tr.Changed {
+			tr.Output = "updated " + path + "\n"
+			if data, err := systemctl("daemon-reload"); err != nil {
+				return failure("systemctl daemon-reload:", err, string(data))
+			}
+		}
+	}
+
+	if t.Args["state"] == nil && t.Args["enabled"] == nil && t.Args["masked"] == nil {
+		return tr
+	}
+	if s := t.Args.String("state"); s != "" && ServiceStateMap[s] == "" {
+		return failure("unknown state, try started|stopped|restarted|reloaded|absent")
+	}
+	res := ensureUnit(name, t.Args)
+	res.Output = tr.Output + res.Output
+	res.Changed = res.Changed || tr.Changed
+	return res
+}
+
+// renderUnit renders sections as an ini style unit file. Unit comes first
+// and Install last, the rest is sorted, as are the keys per section. Values
+// are templated with vars.
+func renderUnit(sections map[string]any, vars model.TaskVars) (string, error) {
+	names := []string{}
+	for name := range sections {
+		names = append(names, name)
+	}
+	rank := func(s string) int {
+		switch s {
+		case "Unit":
+			return 0
+		case "Install":
+			return 2
+		}
+		return 1
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if d := rank(a) - rank(b); d != 0 {
+			return d
+		}
+		return strings.Compare(a, b)
+	})
+
+	var sb strings.Builder
+	for i, name := range names {
+		keys, ok := sections[name].(map[string]any)
+		if !ok {
+			return "", fmt.Errorf("section %s should be a map", name)
+		}
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		fmt.Fprintf(&sb, "[%s]\n", name)
+
+		sortedKeys := []string{}
+		for k := range keys {
+			sortedKeys = append(sortedKeys, k)
+		}
+		sort.Strings(sortedKeys)
+
+		for _, k := range sortedKeys {
+			values, ok := keys[k].([]any)
+			if !ok {
+				values = []any{keys[k]}
+			}
+			for _, v := range values {
+				val, err := tplParseString(unitValue(v), vars)
+				if err != nil {
+					return "", fmt.Errorf("%s.%s: %w", name, k, err)
+				}
+				fmt.Fprintf(&sb, "%s=%s\n", k, val)
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+func unitValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	default:
+		return fmt.Sprint(v)
+	}
+}
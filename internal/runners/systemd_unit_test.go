@@ -0,0 +1,101 @@
+package runners
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gwillem/whip/internal/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_renderUnit(t *testing.T) {
+	got, err := renderUnit(map[string]any{
+		"Install": map[string]any{"WantedBy": "multi-user.target"},
+		"Service": map[string]any{
+			"ExecStart":       []any{"", "/usr/bin/{{ app }} --port 8080"},
+			"Restart":         "always",
+			"NoNewPrivileges": true,
+		},
+		"Unit": map[string]any{"Description": "App"},
+	}, model.TaskVars{"app": "myapp"})
+	require.NoError(t, err)
+	assert.Equal(t, `[Unit]
+Description=App
+
+[Service]
+ExecStart=
+ExecStart=/usr/bin/myapp --port 8080
+NoNewPrivileges=yes
+Restart=always
+
+[Install]
+WantedBy=multi-user.target
+`, got)
+
+	_, err = renderUnit(map[string]any{"Unit": "oops"}, nil)
+	assert.Error(t, err)
+}
+
+func Test_unitPath(t *testing.T) {
+	p, err := unitPath("backup.timer", "")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/systemd/system/backup.timer", p)
+
+	p, err = unitPath("nginx.service", "10-limits.conf")
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/systemd/system/nginx.service.d/10-limits.conf", p)
+
+	for _, bad := range [][2]string{{"nginx", ""}, {"../x.service", ""}, {"x.service", "../y.conf"}, {"x.service", "y"}} {
+		_, err := unitPath(bad[0], bad[1])
+		assert.Error(t, err, bad)
+	}
+}
+
+func Test_systemdUnit(t *testing.T) {
+	oldFs := fs
+	oldFsutil := fsutil
+	oldSystemctl := systemctl
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+		systemctl = oldSystemctl
+	}()
+	createTestFS()
+
+	calls := []string{}
+	systemctl = func(args ...string) ([]byte, error) {
+		if args[0] == "show" {
+			return []byte("LoadState=loaded\nActiveState=active\nUnitFileState=enabled\n"), nil
+		}
+		calls = append(calls, strings.Join(args, " "))
+		return nil, nil
+	}
+
+	task := func() *model.Task {
+		return &model.Task{Args: model.TaskArgs{
+			"name":   "app.service",
+			"dropin": "10-limits.conf",
+			"state":  "started",
+			"unit":   map[string]any{"Service": map[string]any{"LimitNOFILE": 65536}},
+		}}
+	}
+
+	tr := systemdUnit(task())
+	require.Equal(t, Success, tr.Status, tr.Output)
+	assert.True(t, tr.Changed)
+	assert.Equal(t, []string{"daemon-reload"}, calls)
+
+	data, err := fsutil.ReadFile("/etc/systemd/system/app.service.d/10-limits.conf")
+	require.NoError(t, err)
+	assert.Equal(t, "[Service]\nLimitNOFILE=65536\n", string(data))
+
+	calls = nil
+	tr = systemdUnit(task())
+	assert.False(t, tr.Changed)
+	assert.Empty(t, calls)
+
+	tr = systemdUnit(&model.Task{Args: model.TaskArgs{"name": "app.service", "dropin": "10-limits.conf", "state": "absent"}})
+	assert.True(t, tr.Changed)
+	assert.Equal(t, []string{"daemon-reload"}, calls)
+}
@@ -2,8 +2,13 @@ package runners
 
 import (
 	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"slices"
 	"strconv"
@@ -19,11 +24,26 @@ import (
 
 func init() {
 	registerRunner("tree", runner{
-		run:    tree,
-		prerun: treePrerun,
-		meta: runnerMeta{
-			requiredArgs: []string{"src"},
-			optionalArgs: []string{"_assets"},
+		run:      tree,
+		prerun:   treePrerun,
+		validate: validatePrefixes,
+		meta: RunnerMeta{
+			Desc: "Syncs a tree of files and templates from the controller, with owner, mode and handlers per path. Text files over 1 MiB are copied as is, without templating.",
+			Args: []Arg{
+				{Name: "src", Kind: ArgString, Required: true, Desc: "dir on the controller"},
+				{Name: "dst", Kind: ArgString, Default: "$HOME", Desc: "absolute, or relative to $HOME"},
+				{Name: "exclude", Kind: ArgList, Desc: "gitignore style patterns"},
+			},
+			Extra:       "path prefixes, such as /etc/nginx, with " + strings.Join(prefixAttrs, "=, ") + "=",
+			PrefixAttrs: prefixAttrs,
+			Examples: []string{`
+- tree:
+    src: files
+    dst: /
+    /etc/nginx: notify=nginx-reload
+    /etc/nginx/nginx.conf: validate="nginx -t -c %s"
+    /var/www: owner=www-data group=www-data mode=0640
+`},
 		},
 	})
 }
@@ -31,33 +51,102 @@ func init() {
 const (
 	srcRoot      = "/"
 	defaultUmask = os.FileMode(0o022)
+	// larger text files are not parsed as template, so they can be streamed.
+	// Those with template tags are reported, see hasTemplateTags.
+	maxTemplateSize = 1 << 20
 )
 
 type fileMeta struct {
-	uid    *int
-	gid    *int
-	umask  os.FileMode
-	notify []string
+	uid      *int
+	gid      *int
+	umask    os.FileMode
+	mode     *os.FileMode
+	notify   []string
+	validate string
 }
 type prefixMetaMap struct {
 	orderedPrefixes []string
 	metamap         map[string]fileMeta
 }
 
+// filesObj is a file or dir to ensure. File contents are either in data, or
+// streamed from src (a blob in the asset cache) with a known size and checksum.
 type filesObj struct {
-	path  string
-	data  []byte
-	isDir bool
-	mode  os.FileMode
-	umask os.FileMode
-	uid   *int
-	gid   *int
+	path     string
+	data     []byte
+	src      string
+	size     int64
+	checksum []byte
+	isDir    bool
+	mode     os.FileMode
+	umask    os.FileMode
+	uid      *int
+	gid      *int
+	validate string
+	notify   []string
+	// tooLarge is set for text files with template tags, that are too
+	// large to be parsed as template
+	tooLarge bool
+}
+
+// prefixAttrs are the attributes that can be set per path prefix
+var prefixAttrs = []string{"owner", "group", "umask", "mode", "notify", "validate"}
+
+// matchPrefix reports whether prefix applies to path. A prefix is either an
+// exact path or a glob (such as /etc/nginx/*.env) and also applies to
+// everything below the matched path.
+func matchPrefix(prefix, path string) bool {
+	if prefix == srcRoot {
+		return true
+	}
+	for p := path; p != srcRoot && p != "."; p = filepath.Dir(p) {
+		if p == prefix {
+			return true
+		}
+		if ok, _ := filepath.Match(prefix, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// comparePrefixes orders prefixes by specificity: deeper paths are more
+// specific, then those with more literal segments, then those with fewer
+// wildcards and finally longer ones. So /etc/nginx/*.key overrides
+// /etc/nginx, and /etc/nginx/ssl overrides /etc/*/ssl.
+func comparePrefixes(a, b string) int {
+	depthA, literalA, wildA := prefixSegments(a)
+	depthB, literalB, wildB := prefixSegments(b)
+	return cmp.Or(
+		cmp.Compare(depthA, depthB),
+		cmp.Compare(literalA, literalB),
+		cmp.Compare(wildB, wildA),
+		cmp.Compare(len(a), len(b)),
+		strings.Compare(a, b),
+	)
+}
+
+// prefixSegments returns the number of path segments of a prefix, how
+// many of them are literal and the number of wildcards
+func prefixSegments(prefix string) (depth, literal, wildcards int) {
+	for _, seg := range strings.Split(prefix, "/") {
+		if seg == "" {
+			continue
+		}
+		depth++
+		n := strings.Count(seg, "*") + strings.Count(seg, "?") + strings.Count(seg, "[")
+		if n == 0 {
+			literal++
+		}
+		wildcards += n
+	}
+	return depth, literal, wildcards
 }
 
 func (pm *prefixMetaMap) getMeta(path string) fileMeta {
 	finalMeta := fileMeta{}
 	for _, prefix := range pm.orderedPrefixes {
-		if strings.HasPrefix(path, prefix) {
+		if matchPrefix(prefix, path) {
 			meta := pm.metamap[prefix]
 			if meta.uid != nil {
 				finalMeta.uid = meta.uid
@@ -68,9 +157,15 @@ func (pm *prefixMetaMap) getMeta(path string) fileMeta {
 			if meta.umask > 0 {
 				finalMeta.umask = meta.umask
 			}
+			if meta.mode != nil {
+				finalMeta.mode = meta.mode
+			}
 			if meta.notify != nil {
 				finalMeta.notify = append(finalMeta.notify, meta.notify...)
 			}
+			if meta.validate != "" {
+				finalMeta.validate = meta.validate
+			}
 		}
 	}
 	return finalMeta
@@ -80,7 +175,7 @@ func treePrerun(t *model.Task) (tr model.TaskResult) {
 	// should load assets (if any) into _assets
 	// pp.Println(t)
 	path := t.Args.String("src")
-	assets, err := assets.DirToAsset(path)
+	assets, err := assets.DirToAsset(path, t.Args.StringSlice("exclude"))
 	if err != nil {
 		return failure("BOOHOO", fmt.Errorf("assets loader on path %s: %s", path, err))
 	}
@@ -113,62 +208,55 @@ func tree(t *model.Task) (tr model.TaskResult) {
 		return failure("wrong type of _assets?")
 	}
 
-	srcFs, err := assets.AssetToFS(&rawAssets)
-	if err != nil {
-		return failure("cannot convert assets to fs", err)
-	}
+	// sort, so that dirs are created before their contents
+	srcFiles := slices.Clone(rawAssets.Files)
+	slices.SortFunc(srcFiles, func(a, b model.File) int {
+		return strings.Compare(a.Path, b.Path)
+	})
 
 	tr.Notify = make(map[string]bool)
 
-	err = afero.Walk(srcFs, srcRoot, func(srcPath string, srcFi os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	for _, src := range srcFiles {
+		srcPath := filepath.Join(srcRoot, src.Path)
 		if srcPath == srcRoot {
-			return nil // don't modify root element
+			continue // don't modify root element
 		}
 		dstPath := filepath.Join(dstRoot, srcPath)
 
 		f := filesObj{
 			path:  dstPath,
-			isDir: srcFi.IsDir(),
-			mode:  srcFi.Mode(),
+			isDir: src.Mode.IsDir(),
+			mode:  src.Mode,
 		}
 
 		if !f.isDir {
-			f.data, err = afero.ReadFile(srcFs, srcPath)
-			if err != nil {
-				return fmt.Errorf("afero read rr on %s: %w", srcPath, err)
+			if err := f.loadContents(src, t.Vars); err != nil {
+				return failure(fmt.Errorf("cannot load %s: %w", srcPath, err))
 			}
-
-			// template?
-			if isText(f.data) {
-				// log.Debug("parsing template", srcPath, "with vars", vars)
-				f.data, err = tplParseBytes(f.data, t.Vars)
-				if err != nil {
-					return fmt.Errorf("tplParseBytes error on %s: %w", srcPath, err)
-				}
-			}
-
 		}
 
-		// update srcFs[srcPath] and srcFi with prefix meta, if any
+		// update f with prefix meta, if any
 		meta := pm.getMeta(srcPath)
 		f.uid = meta.uid
 		f.gid = meta.gid
+		f.validate = meta.validate
+		f.notify = slices.Concat(meta.notify, t.Notify)
 
-		// apply umask to default 0o666 permissions
+		// apply umask to default 0o666 permissions, unless there is an
+		// explicit file mode (which is not applied to dirs)
 		umask := defaultUmask
 		if meta.umask > 0 {
 			umask = meta.umask
 		}
 		f.mode = f.mode &^ umask
+		if meta.mode != nil && !f.isDir {
+			f.mode = *meta.mode
+		}
 
-		// output += pp.Sprintln(dstPath)
 		// from here on, ensure path
 		changed, err := ensurePath(f)
 		if err != nil {
-			return fmt.Errorf("ensurePath error on %s: %w", dstPath, err)
+			return failure(fmt.Errorf("ensurePath error on %s: %w", dstPath, err))
 		}
 		status := "skip"
 		if changed {
@@ -178,11 +266,10 @@ func tree(t *model.Task) (tr model.TaskResult) {
 				tr.Notify[n] = true
 			}
 		}
+		if f.tooLarge {
+			dstPath += " (not templated, larger than 1 MiB)"
+		}
 		output += fmt.Sprintf("%-7s %s\n", status, dstPath)
-		return nil
-	})
-	if err != nil {
-		return failure(err)
 	}
 
 	tr.Output = output
@@ -190,6 +277,93 @@ func tree(t *model.Task) (tr model.TaskResult) {
 	return tr
 }
 
+// loadContents reads text files into memory and parses them as template.
+// Binary and large files are streamed from the asset cache instead.
+func (f *filesObj) loadContents(src model.File, vars map[string]any) error {
+	path, err := assets.BlobPath(src.Hash)
+	if err != nil {
+		return err
+	}
+
+	fh, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	head := make([]byte, 1024)
+	n, err := io.ReadFull(fh, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	text := isText(head[:n])
+	if src.Size <= maxTemplateSize && text {
+		data, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return err
+		}
+		f.data, err = tplParseBytes(data, vars)
+		if err != nil {
+			return fmt.Errorf("tplParseBytes error: %w", err)
+		}
+		return nil
+	}
+	if text {
+		if f.tooLarge, err = hasTemplateTags(io.MultiReader(bytes.NewReader(head[:n]), fh)); err != nil {
+			return err
+		}
+		if f.tooLarge {
+			log.Warn(f.path, "has template tags, but is larger than 1 MiB, so it is copied as is")
+		}
+	}
+
+	f.src = path
+	f.size = src.Size
+	f.checksum, err = hex.DecodeString(src.Hash)
+	return err
+}
+
+// hasTemplateTags reports whether r contains {{ or {%, without reading it
+// into memory at once
+func hasTemplateTags(r io.Reader) (bool, error) {
+	buf := make([]byte, 32*1024)
+	var prev byte
+	for {
+		n, err := r.Read(buf)
+		chunk := buf[:n]
+		if n > 0 && prev == '{' && (chunk[0] == '{' || chunk[0] == '%') {
+			return true, nil
+		}
+		if bytes.Contains(chunk, []byte("{{")) || bytes.Contains(chunk, []byte("{%")) {
+			return true, nil
+		}
+		if n > 0 {
+			prev = chunk[n-1]
+		}
+		if err == io.EOF {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+	}
+}
+
+// writeContents writes the file contents to w
+func (f *filesObj) writeContents(w io.Writer) error {
+	if f.src == "" {
+		_, err := w.Write(f.data)
+		return err
+	}
+	fh, err := fs.Open(f.src)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+	_, err = io.Copy(w, fh)
+	return err
+}
+
 func getDstRoot(arg any) string {
 	dstRoot, _ := arg.(string)
 	switch {
@@ -203,8 +377,75 @@ func getDstRoot(arg any) string {
 	return dstRoot
 }
 
+// validatePrefixes checks the path prefix args of a tree task on the
+// controller, owners and groups can only be looked up at the target
+func validatePrefixes(args model.TaskArgs) error {
+	keys := []string{}
+	for k := range args {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	errs := []error{}
+	for _, k := range keys {
+		v := args[k]
+		switch {
+		case strings.HasPrefix(k, "/"):
+			if _, err := parsePrefixAttrs(k, v); err != nil {
+				errs = append(errs, err)
+			}
+		case strings.HasPrefix(k, "_"):
+			// internal, such as _assets
+		default:
+			if _, ok := runners["tree"].meta.arg(k); !ok {
+				errs = append(errs, fmt.Errorf("unknown arg %q, path prefixes should be absolute", k))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parsePrefixAttrs parses and checks the attributes of a path prefix, such
+// as "owner=www-data mode=0640"
+func parsePrefixAttrs(prefix string, v any) (model.TaskArgs, error) {
+	argStr, ok := v.(string)
+	if !ok {
+		return nil, fmt.Errorf("prefix args %v is not a string", v)
+	}
+	if _, err := filepath.Match(prefix, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %s: %w", prefix, err)
+	}
+
+	attrs := parser.ParseArgString(argStr)
+	for k := range attrs {
+		if k == parser.DefaultArg {
+			if attrs.String(k) != "" {
+				return nil, fmt.Errorf("prefix %s has invalid attribute %q, should be key=value", prefix, attrs.String(k))
+			}
+			continue
+		}
+		if !slices.Contains(prefixAttrs, k) {
+			return nil, fmt.Errorf("prefix %s has unknown attribute %q, try one of %s", prefix, k, strings.Join(prefixAttrs, ", "))
+		}
+	}
+
+	if attrs.String("umask") != "" {
+		if _, err := strconv.ParseInt(attrs.String("umask"), 8, 32); err != nil {
+			return nil, fmt.Errorf("cannot parse octal umask %s", attrs.String("umask"))
+		}
+	}
+	if attrs.String("mode") != "" {
+		if mi, err := strconv.ParseUint(attrs.String("mode"), 8, 32); err != nil || mi > 0o777 {
+			return nil, fmt.Errorf("cannot parse octal mode %s", attrs.String("mode"))
+		}
+	}
+	return attrs, nil
+}
+
 // Takes meta attributes for a "files" task and returns a prefixMetaMap so that
-// the runner can chown/chmod part of the file tree and notify different handlers
+// the runner can chown/chmod part of the file tree and notify different handlers.
+// Keys are exact paths or globs, more specific keys override others, see
+// comparePrefixes.
 func parsePrefixMeta(args model.TaskArgs) (*prefixMetaMap, error) {
 	pm := prefixMetaMap{
 		orderedPrefixes: []string{},
@@ -216,34 +457,33 @@ func parsePrefixMeta(args model.TaskArgs) (*prefixMetaMap, error) {
 			continue
 		}
 
-		argStr, ok := v.(string)
-		if !ok {
-			return nil, fmt.Errorf("prefix args %v is not a string", v)
+		attrs, err := parsePrefixAttrs(prefix, v)
+		if err != nil {
+			return nil, err
 		}
-		attrs := parser.ParseArgString(argStr)
 
 		fm := fileMeta{}
 		if attrs.String("umask") != "" {
-			ui, err := strconv.ParseInt(attrs.String("umask"), 8, 32)
-			if err != nil {
-				return nil, fmt.Errorf("cannot parse octal umask %s", attrs.String("umask"))
-			}
+			ui, _ := strconv.ParseInt(attrs.String("umask"), 8, 32)
 			fm.umask = os.FileMode(ui)
 		}
 
-		var uid, gid int
-
-		username := attrs.String("owner")
+		if attrs.String("mode") != "" {
+			mi, _ := strconv.ParseUint(attrs.String("mode"), 8, 32)
+			mode := os.FileMode(mi)
+			fm.mode = &mode
+		}
 
-		if username != "" {
+		if username := attrs.String("owner"); username != "" {
 			owner, err := osUser.Lookup(username)
 			if err != nil {
 				return nil, fmt.Errorf("cannot find user %s", username)
 			}
-			uid, err = strconv.Atoi(owner.Uid)
+			uid, err := strconv.Atoi(owner.Uid)
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse uid %s", owner.Uid)
 			}
+			fm.uid = &uid
 		}
 
 		if attrs.String("group") != "" {
@@ -252,18 +492,23 @@ func parsePrefixMeta(args model.TaskArgs) (*prefixMetaMap, error) {
 				return nil, fmt.Errorf("cannot find group %s", attrs.String("group"))
 			}
 
-			gid, err = strconv.Atoi(group.Gid)
+			gid, err := strconv.Atoi(group.Gid)
 			if err != nil {
 				return nil, fmt.Errorf("cannot parse gid %s", group.Gid)
 			}
+			fm.gid = &gid
 		}
 
 		if attrs.String("notify") != "" {
 			fm.notify = parser.StringToSlice(attrs.String("notify"))
 		}
 
-		fm.uid = &uid
-		fm.gid = &gid
+		if v := attrs.String("validate"); v != "" {
+			if !strings.Contains(v, "%s") {
+				return nil, fmt.Errorf("validate command for %s should contain %%s: %s", prefix, v)
+			}
+			fm.validate = v
+		}
 
 		pm.metamap[prefix] = fm
 	}
@@ -271,7 +516,8 @@ func parsePrefixMeta(args model.TaskArgs) (*prefixMetaMap, error) {
 	for prefix := range pm.metamap {
 		pm.orderedPrefixes = append(pm.orderedPrefixes, prefix)
 	}
-	slices.Sort(pm.orderedPrefixes) // sort prefixes to ensure shorted prefix is first
+	// least specific first, so more specific prefixes override them
+	slices.SortFunc(pm.orderedPrefixes, comparePrefixes)
 
 	return &pm, nil
 }
@@ -329,8 +575,13 @@ func ensureFile(f filesObj) (changed bool, err error) {
 		return false, fmt.Errorf("read error on %s: %w", f.path, err)
 	}
 
+	size, checksum := f.size, f.checksum
+	if f.src == "" {
+		size, checksum = int64(len(f.data)), getDataChecksum(f.data)
+	}
+
 	dataDiffers := func() bool {
-		if fi.Size() != int64(len(f.data)) {
+		if fi.Size() != size {
 			return true
 		}
 		chk, err := getFileChecksum(fs, f.path)
@@ -338,7 +589,7 @@ func ensureFile(f filesObj) (changed bool, err error) {
 			log.Warn("cannot get checksum for", f.path, err)
 			return true
 		}
-		return !bytes.Equal(getDataChecksum(f.data), chk)
+		return !bytes.Equal(checksum, chk)
 	}
 
 	if fi != nil && fi.IsDir() {
@@ -366,7 +617,7 @@ func ensureFile(f filesObj) (changed bool, err error) {
 		}()
 
 		// Write data to the temporary file
-		_, err = tempFile.Write(f.data)
+		err = f.writeContents(tempFile)
 		if err != nil {
 			return false, fmt.Errorf("write error to temp file %s for %s: %w", tempPath, f.path, err)
 		}
@@ -379,6 +630,17 @@ func ensureFile(f filesObj) (changed bool, err error) {
 			return false, fmt.Errorf("chmod error on temp file %s for %s: %w", tempPath, f.path, err)
 		}
 
+		// don't replace the live file if the validator rejects the new one
+		if f.validate != "" {
+			if err := validateFile(f.validate, tempPath); err != nil {
+				return false, fmt.Errorf("validation failed for %s: %w", f.path, err)
+			}
+		}
+
+		if err := backupFile(f.path, f.notify); err != nil {
+			return false, fmt.Errorf("backup error for %s: %w", f.path, err)
+		}
+
 		// Perform the atomic rename
 		err = fs.Rename(tempPath, f.path)
 		if err != nil {
@@ -408,6 +670,17 @@ func ensureFile(f filesObj) (changed bool, err error) {
 	return changed, nil
 }
 
+// validateFile runs cmd with %s substituted by the shell quoted path and
+// returns the validator's output as error if it exits non-zero
+func validateFile(cmd, path string) error {
+	cmd = strings.ReplaceAll(cmd, "%s", shellQuote(path))
+	data, err := exec.Command("/bin/sh", "-c", cmd).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w\n%s", cmd, err, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
+
 func chown(path string, u, g *int) (changed bool, err error) {
 	uid := -1
 	gid := -1
@@ -436,10 +709,11 @@ func chown(path string, u, g *int) (changed bool, err error) {
 		if g != nil && stat.Gid != uint32(*g) {
 			gid = *g
 		}
+	}
 
-		if uid == -1 && gid == -1 {
-			return false, nil
-		}
+	// also without stat_t, so paths without owner or group are unchanged
+	if uid == -1 && gid == -1 {
+		return false, nil
 	}
 
 	if err := fs.Chown(path, uid, gid); err != nil {
@@ -1,12 +1,17 @@
 package runners
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"os/user"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	log "github.com/gwillem/go-simplelog"
+	"github.com/gwillem/whip/internal/assets"
 	"github.com/gwillem/whip/internal/model"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
@@ -95,8 +100,8 @@ func Test_parsePrefixMeta(t *testing.T) {
 			want: &prefixMetaMap{
 				orderedPrefixes: []string{
 					"/a",
-					"/a/b/c",
 					"/d",
+					"/a/b/c",
 				},
 				metamap: map[string]fileMeta{
 					"/a":     *newFileMeta(testUID, testGID, []string{testHandlerA}),
@@ -200,3 +205,217 @@ func Test_ensurePathUpdatesFileMode(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, fi.Mode(), target)
 }
+
+func Test_ensureFileValidate(t *testing.T) {
+	log.SetLevel(log.LevelError)
+	defer log.SetLevel(log.LevelDebug)
+
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+	}()
+	// validator runs as external command, so needs a real fs
+	fs = afero.NewOsFs()
+	fsutil = &afero.Afero{Fs: fs}
+
+	// the path is quoted for the shell
+	dir := filepath.Join(t.TempDir(), "it's a $dir; true")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	testPath := filepath.Join(dir, "nginx.conf")
+	require.NoError(t, os.WriteFile(testPath, []byte("good"), 0o644))
+
+	bad := filesObj{
+		path:     testPath,
+		data:     []byte("bad"),
+		mode:     0o644,
+		validate: "! grep -q bad %s",
+	}
+	changed, err := ensureFile(bad)
+	require.Error(t, err)
+	require.False(t, changed)
+
+	data, err := os.ReadFile(testPath)
+	require.NoError(t, err)
+	require.Equal(t, "good", string(data))
+
+	good := bad
+	good.data = []byte("better")
+	changed, err = ensureFile(good)
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	data, err = os.ReadFile(testPath)
+	require.NoError(t, err)
+	require.Equal(t, "better", string(data))
+}
+
+func Test_parsePrefixMetaValidate(t *testing.T) {
+	pmm, err := parsePrefixMeta(model.TaskArgs{"/etc/nginx": `validate="nginx -t -c %s"`})
+	require.NoError(t, err)
+	require.Equal(t, "nginx -t -c %s", pmm.getMeta("/etc/nginx/nginx.conf").validate)
+
+	_, err = parsePrefixMeta(model.TaskArgs{"/etc/nginx": "validate=true"})
+	require.Error(t, err)
+}
+
+func Test_parsePrefixMetaAttrs(t *testing.T) {
+	osUser = getDummyOsUser()
+	defer func() {
+		osUser = realOsUser{}
+	}()
+
+	pmm, err := parsePrefixMeta(model.TaskArgs{
+		"/etc/nginx":        fmt.Sprintf("owner=%s umask=027", testUser),
+		"/etc/nginx/*.env":  "mode=0600",
+		"/etc/nginx/ssl":    "mode=0400",
+		"/etc/nginx/ssl.db": "mode=0644",
+	})
+	require.NoError(t, err)
+
+	mode := func(m os.FileMode) *os.FileMode { return &m }
+	uid := testUID
+
+	fm := pmm.getMeta("/etc/nginx/secrets.env")
+	require.Equal(t, fileMeta{uid: &uid, umask: 0o027, mode: mode(0o600)}, fm)
+
+	fm = pmm.getMeta("/etc/nginx/nginx.conf")
+	require.Equal(t, fileMeta{uid: &uid, umask: 0o027}, fm)
+
+	fm = pmm.getMeta("/etc/nginx/ssl/site.key")
+	require.Equal(t, mode(0o400), fm.mode)
+
+	fm = pmm.getMeta("/etc/nginx/ssl.db")
+	require.Equal(t, mode(0o644), fm.mode)
+
+	fm = pmm.getMeta("/etc/nginxfoo")
+	require.Equal(t, fileMeta{}, fm)
+
+	for _, bad := range []string{"handler=nginx", "mode=0999", "mode=rw", "umask=022 bogus"} {
+		_, err = parsePrefixMeta(model.TaskArgs{"/etc": bad})
+		require.Error(t, err, bad)
+	}
+}
+
+func Test_treeFromBlobs(t *testing.T) {
+	log.SetLevel(log.LevelError)
+	defer log.SetLevel(log.LevelDebug)
+
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+		assets.SetBlobDir("")
+	}()
+	createTestFS()
+	assets.SetBlobDir("/blobs")
+
+	addBlob := func(data []byte) model.File {
+		hash := hex.EncodeToString(getDataChecksum(data))
+		require.NoError(t, fsutil.WriteFile("/blobs/"+hash, data, 0o600))
+		return model.File{Hash: hash, Size: int64(len(data)), Mode: 0o666}
+	}
+
+	tpl := addBlob([]byte("hello {{ name }}\n"))
+	tpl.Path = "/etc/hello.conf"
+	bin := addBlob([]byte{0x00, 0x01, 0x02, 0xff})
+	bin.Path = "/etc/app.bin"
+	largeData := strings.Repeat("x", maxTemplateSize) + "{{ name }}\n"
+	large := addBlob([]byte(largeData))
+	large.Path = "/etc/large.txt"
+
+	require.NoError(t, fs.MkdirAll("/dst", 0o755))
+	task := &model.Task{
+		Args: model.TaskArgs{
+			"dst": "/dst",
+			"_assets": model.Asset{Files: []model.File{
+				bin, tpl, large, {Path: "/etc", Mode: os.ModeDir | 0o777},
+			}},
+		},
+		Vars: model.TaskVars{"name": "world"},
+	}
+
+	tr := tree(task)
+	require.Equal(t, Success, tr.Status, tr.Output)
+	require.True(t, tr.Changed)
+
+	data, err := fsutil.ReadFile("/dst/etc/hello.conf")
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", string(data))
+
+	data, err = fsutil.ReadFile("/dst/etc/app.bin")
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x01, 0x02, 0xff}, data)
+
+	// too large to template, copied as is and reported
+	data, err = fsutil.ReadFile("/dst/etc/large.txt")
+	require.NoError(t, err)
+	require.Equal(t, largeData, string(data))
+	require.Contains(t, tr.Output, "/dst/etc/large.txt (not templated, larger than 1 MiB)")
+	require.NotContains(t, tr.Output, "hello.conf (not templated")
+
+	fi, err := fs.Stat("/dst/etc/app.bin")
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0o644), fi.Mode())
+}
+
+func Test_hasTemplateTags(t *testing.T) {
+	for in, want := range map[string]bool{
+		"plain text":       false,
+		"a { b } c":        false,
+		"hello {{ name }}": true,
+		"{% if x %}":       true,
+		"trailing {":       false,
+	} {
+		// one byte at a time, to test tags across reads
+		got, err := hasTemplateTags(iotest.OneByteReader(strings.NewReader(in)))
+		require.NoError(t, err)
+		require.Equal(t, want, got, in)
+	}
+}
+
+func Test_chownWithoutOwner(t *testing.T) {
+	oldFs := fs
+	oldFsutil := fsutil
+	defer func() {
+		fs = oldFs
+		fsutil = oldFsutil
+	}()
+	// the test fs has no stat_t, so chown can't compare the current owner
+	createTestFS()
+	require.NoError(t, afero.WriteFile(fs, "/file", []byte("x"), 0o644))
+
+	changed, err := chown("/file", nil, nil)
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	uid := 1000
+	changed, err = chown("/file", &uid, nil)
+	require.NoError(t, err)
+	require.True(t, changed)
+}
+
+func Test_prefixMetaSpecificity(t *testing.T) {
+	pm, err := parsePrefixMeta(model.TaskArgs{
+		"/":                "mode=0444",
+		"/etc/nginx":       "mode=0644",
+		"/etc/nginx/*.key": "mode=0600",
+		"/etc/*/ssl":       "mode=0640",
+		"/etc/nginx/ssl":   "mode=0400",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"/", "/etc/nginx", "/etc/*/ssl", "/etc/nginx/*.key", "/etc/nginx/ssl"}, pm.orderedPrefixes)
+
+	for path, want := range map[string]os.FileMode{
+		"/etc/hosts":              0o444,
+		"/etc/nginx/nginx.conf":   0o644,
+		"/etc/nginx/site.key":     0o600,
+		"/etc/apache/ssl/cert":    0o640,
+		"/etc/nginx/ssl/cert":     0o400,
+		"/etc/nginx/ssl/site.key": 0o400,
+	} {
+		require.Equal(t, want, *pm.getMeta(path).mode, path)
+	}
+}
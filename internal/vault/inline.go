@@ -0,0 +1,79 @@
+package vault
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"filippo.io/age/armor"
+)
+
+// InlineTag marks an encrypted value in yaml, such as:
+//
+//	password: !vault |
+//	  -----BEGIN AGE ENCRYPTED FILE-----
+//	  ...
+const InlineTag = "!vault"
+
+// EncryptString encrypts a value with age, as armored text that can be used
+// as inline !vault value in a playbook or vars file
+func EncryptString(plain string) (string, error) {
+	var v Vaulter
+	for _, candidate := range allVaulters {
+		if _, ok := candidate.(*ageVault); ok {
+			v = candidate
+		}
+	}
+	if v == nil || !v.Ready() {
+		return "", fmt.Errorf("cannot encrypt, set $%s or create %s", ageEnv, ageEnvScript)
+	}
+
+	buf := &bytes.Buffer{}
+	w := armor.NewWriter(buf)
+	if err := v.Encrypt(strings.NewReader(plain), w); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// IsEncryptedString reports whether s is an inline vault value, which is
+// armored age or Ansible Vault
+func IsEncryptedString(s string) bool {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, armor.Header) {
+		return true
+	}
+	_, err := findVaulter([]byte(s))
+	return err == nil
+}
+
+// DecryptString decrypts an inline vault value
+func DecryptString(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	var r io.Reader = strings.NewReader(s)
+	if strings.HasPrefix(s, armor.Header) {
+		r = armor.NewReader(r)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("cannot read vault value: %w", err)
+	}
+
+	v, err := findVaulter(data)
+	if err != nil {
+		return "", err
+	}
+	plain, err := v.Decrypt(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	out, err := io.ReadAll(plain)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
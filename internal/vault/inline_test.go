@@ -0,0 +1,43 @@
+package vault
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EncryptString(t *testing.T) {
+	oldAll := allVaulters
+	defer func() {
+		allVaulters = oldAll
+	}()
+	allVaulters = []Vaulter{ageTestVault}
+
+	enc, err := EncryptString("s3cret")
+	require.NoError(t, err)
+	assert.Contains(t, enc, "-----BEGIN AGE ENCRYPTED FILE-----\n")
+	assert.True(t, IsEncryptedString(enc))
+
+	plain, err := DecryptString("\n" + enc)
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", plain)
+}
+
+func Test_DecryptStringAnsible(t *testing.T) {
+	t.Setenv("ANSIBLE_VAULT_PASSWORD", "test")
+	buf := &bytes.Buffer{}
+	require.NoError(t, (&ansibleVault{}).Encrypt(bytes.NewReader([]byte("s3cret")), buf))
+	assert.True(t, IsEncryptedString(buf.String()))
+
+	plain, err := DecryptString(buf.String() + "\n")
+	require.NoError(t, err)
+	assert.Equal(t, "s3cret", plain)
+}
+
+func Test_DecryptStringPlain(t *testing.T) {
+	assert.False(t, IsEncryptedString("s3cret"))
+	_, err := DecryptString("s3cret")
+	assert.Error(t, err)
+}
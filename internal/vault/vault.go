@@ -81,6 +81,23 @@ func Open(path string) (io.ReadCloser, error) {
 	return &readCloserWrapper{r, fh}, nil
 }
 
+// IsEncrypted reports whether the file at path is encrypted with any of
+// the supported vaults
+func IsEncrypted(path string) (bool, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer fh.Close()
+
+	buffer := make([]byte, magicSize)
+	if _, e := io.ReadFull(fh, buffer); e != nil && e != io.ErrUnexpectedEOF && e != io.EOF {
+		return false, e
+	}
+	_, err = findVaulter(buffer)
+	return err == nil, nil
+}
+
 func isEncrypted(path string, v Vaulter) (bool, error) {
 	fh, err := os.Open(path)
 	if err != nil {